@@ -0,0 +1,71 @@
+package drive
+
+import (
+	"context"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+// Quota returns the number of bytes used by the Drive account and its
+// storage limit. The limit is zero if the account has unlimited storage.
+func (d *driveImpl) Quota() (used, limit int64, err error) {
+	const op = "cloud/storage/drive.Quota"
+	if err := d.checkOpen(op); err != nil {
+		return 0, 0, err
+	}
+	ctx := context.Background()
+	var a *drive.About
+	err = d.retry(ctx, "about.get", func(ctx context.Context) error {
+		var err error
+		a, err = d.about.Get().Fields("storageQuota(limit, usage)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return 0, 0, errors.E(op, errKind(err), err)
+	}
+	if a.StorageQuota == nil {
+		return 0, 0, errors.E(op, errors.IO, errors.Str("no storage quota in response"))
+	}
+	return a.StorageQuota.Usage, a.StorageQuota.Limit, nil
+}
+
+// Ping checks that the Drive API can be reached with the configured
+// credentials by making a single cheap request. New does not talk to
+// Drive unless the "validateCredentials" option is set, so callers that
+// want to fail fast on bad credentials or an unreachable service should
+// call Ping after New.
+func (d *driveImpl) Ping(ctx context.Context) error {
+	const op = "cloud/storage/drive.Ping"
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	err := d.call(ctx, "about.get", func(ctx context.Context) error {
+		_, err := d.about.Get().Fields("user(emailAddress)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return errors.E(op, errKind(err), err)
+	}
+	return nil
+}
+
+// HealthCheck checks that the storage is usable: that Drive can be reached
+// and that the credentials grant access to the space and folder in which
+// files are stored. It makes a single request listing at most one file, and
+// returns an error of kind errors.Permission if the credentials are rejected.
+func (d *driveImpl) HealthCheck(ctx context.Context) error {
+	const op = "cloud/storage/drive.HealthCheck"
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	err := d.call(ctx, "files.list", func(ctx context.Context) error {
+		_, err := d.list("").PageSize(1).Fields("files(id)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		_, err = d.checkAppData(err)
+		return errors.E(op, errKind(err), err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package drive
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestQuota(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.quota = 1 << 30
+	if err := d.Put("ref", []byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	used, limit, err := d.Quota()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 9 || limit != 1<<30 {
+		t.Errorf("Quota() = %d, %d; want 9, %d", used, limit, 1<<30)
+	}
+}
+
+func TestPing(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	f.fail = func(method string, r *http.Request) int {
+		return http.StatusUnauthorized
+	}
+	if err := d.Ping(context.Background()); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+	if n := f.count("about"); n != 2 {
+		t.Errorf("got %d about requests, want 2", n)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	if err := d.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		code int
+		kind errors.Kind
+	}{
+		{http.StatusUnauthorized, errors.Permission},
+		{http.StatusInternalServerError, errors.IO},
+	} {
+		f.fail = func(method string, r *http.Request) int {
+			return tt.code
+		}
+		if err := d.HealthCheck(context.Background()); !errors.Is(tt.kind, err) {
+			t.Errorf("with status %d: got error %v, want %v", tt.code, err, tt.kind)
+		}
+	}
+}
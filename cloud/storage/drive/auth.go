@@ -0,0 +1,285 @@
+package drive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"drive.upspin.io/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// tokenKeys holds the options which together describe an OAuth2 token.
+var tokenKeys = []string{"accessToken", "tokenType", "refreshToken", "expiry"}
+
+// httpClient returns an HTTP client which authenticates its requests using
+// the credentials described by the options. These are either a service
+// account key, named by the "serviceAccountKey" option, or an OAuth2 token
+// as returned by token. The client is granted access to the given Drive space.
+func httpClient(ctx context.Context, o *storage.Opts, space string) (*http.Client, error) {
+	if key, ok := o.Opts["serviceAccountKey"]; ok {
+		for _, k := range append([]string{"tokenFile"}, tokenKeys...) {
+			if _, ok := o.Opts[k]; ok {
+				return nil, errors.E(errors.Invalid, errors.Errorf("ambiguous configuration: serviceAccountKey can not be combined with %s", k))
+			}
+		}
+		return serviceAccountClient(ctx, o, key, space)
+	}
+	cfg, err := oauthConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := token(o)
+	if err != nil {
+		return nil, err
+	}
+	ts := cfg.TokenSource(ctx, tok)
+	if file, ok := o.Opts["tokenFile"]; ok {
+		// Persist refreshed tokens so that restarts can reuse them.
+		ts = &fileTokenSource{src: ts, name: file, last: tok}
+	}
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// serviceAccountClient returns an HTTP client authenticated as the service
+// account whose JSON key is stored in the named file. If the
+// "serviceAccountSubject" option is set, the service account impersonates
+// that user through domain-wide delegation. The "tokenURL" and "scopes"
+// options override those of the key and of the space.
+func serviceAccountClient(ctx context.Context, o *storage.Opts, name, space string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	scopes := []string{drive.DriveAppdataScope}
+	if space == "drive" {
+		scopes = []string{drive.DriveScope}
+	}
+	if v, ok := o.Opts["scopes"]; ok {
+		if scopes, err = parseScopes(v); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, errors.E(errors.Invalid, errors.Errorf("couldn't parse service account key %s: %v", name, err))
+	}
+	if v, ok := o.Opts["tokenURL"]; ok {
+		if err := checkURL("tokenURL", v); err != nil {
+			return nil, err
+		}
+		cfg.TokenURL = v
+	}
+	cfg.Subject = o.Opts["serviceAccountSubject"]
+	return cfg.Client(ctx), nil
+}
+
+// oauthConfig returns the OAuth2 configuration used to refresh tokens. It
+// is config.OAuth2 with the endpoints and scopes overridden by the
+// "authURL", "tokenURL" and "scopes" options, if set.
+func oauthConfig(o *storage.Opts) (*oauth2.Config, error) {
+	cfg := *config.OAuth2
+	if v, ok := o.Opts["authURL"]; ok {
+		if err := checkURL("authURL", v); err != nil {
+			return nil, err
+		}
+		cfg.Endpoint.AuthURL = v
+	}
+	if v, ok := o.Opts["tokenURL"]; ok {
+		if err := checkURL("tokenURL", v); err != nil {
+			return nil, err
+		}
+		cfg.Endpoint.TokenURL = v
+	}
+	if v, ok := o.Opts["scopes"]; ok {
+		scopes, err := parseScopes(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Scopes = scopes
+	}
+	return &cfg, nil
+}
+
+// checkURL returns an error if v, the value of the option with the given
+// key, is not an absolute URL.
+func checkURL(key, v string) error {
+	u, err := url.Parse(v)
+	if err != nil || !u.IsAbs() {
+		return errors.E(errors.Invalid, errors.Errorf("%s must be an absolute URL, got %q", key, v))
+	}
+	return nil
+}
+
+// scopesOrigin describes how the OAuth2 scopes of the credentials described
+// by the options were requested, to help diagnose those lacking one.
+func scopesOrigin(o *storage.Opts, space string) string {
+	if v, ok := o.Opts["scopes"]; ok {
+		return fmt.Sprintf("the scopes option requested %s", v)
+	}
+	if _, ok := o.Opts["serviceAccountKey"]; ok {
+		if space == "drive" {
+			return fmt.Sprintf("the service account requested %s", drive.DriveScope)
+		}
+		return fmt.Sprintf("the service account requested %s, which its domain-wide delegation may not allow", drive.DriveAppdataScope)
+	}
+	return fmt.Sprintf("the token was granted for the scopes requested when it was obtained, %s by default", strings.Join(config.OAuth2.Scopes, ", "))
+}
+
+// parseScopes parses the comma-separated list of OAuth2 scopes v.
+func parseScopes(v string) ([]string, error) {
+	var scopes []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.E(errors.Invalid, errors.Errorf("scopes must list at least one scope, got %q", v))
+	}
+	return scopes, nil
+}
+
+// OptsFromToken returns the options describing tok, in the format expected
+// by New, to which other options may be added.
+func OptsFromToken(tok *oauth2.Token) map[string]string {
+	return map[string]string{
+		"accessToken":  tok.AccessToken,
+		"tokenType":    tok.Type(),
+		"refreshToken": tok.RefreshToken,
+		"expiry":       tok.Expiry.Format(time.RFC3339),
+	}
+}
+
+// token returns the OAuth2 token described by the options, which is either
+// read from the file named by the "tokenFile" option or built from the
+// individual options listed in tokenKeys.
+func token(o *storage.Opts) (*oauth2.Token, error) {
+	if file, ok := o.Opts["tokenFile"]; ok {
+		for _, k := range tokenKeys {
+			if _, ok := o.Opts[k]; ok {
+				return nil, errors.E(errors.Invalid, errors.Errorf("ambiguous configuration: tokenFile can not be combined with %s", k))
+			}
+		}
+		return tokenFromFile(file)
+	}
+	var missing []string
+	for _, k := range tokenKeys {
+		if _, ok := o.Opts[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.E(errors.Internal, &MissingOptsError{Missing: missing})
+	}
+	if err := checkTokenType(o.Opts["tokenType"]); err != nil {
+		return nil, err
+	}
+	e, err := time.Parse(time.RFC3339, o.Opts["expiry"])
+	if err != nil {
+		return nil, errors.E(errors.Internal, errors.Errorf("couldn't parse expiry %q, need an RFC3339 time stamp such as %q: %v", o.Opts["expiry"], time.RFC3339, err))
+	}
+	return &oauth2.Token{
+		AccessToken:  o.Opts["accessToken"],
+		TokenType:    o.Opts["tokenType"],
+		RefreshToken: o.Opts["refreshToken"],
+		Expiry:       e,
+	}, nil
+}
+
+// tokenFromFile reads a JSON-encoded OAuth2 token from the named file.
+func tokenFromFile(name string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.E(errors.IO, err)
+	}
+	tok := new(oauth2.Token)
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, errors.E(errors.Invalid, errors.Errorf("couldn't parse token file %s: %v", name, err))
+	}
+	// An empty token type is taken to mean Bearer by the oauth2 package.
+	if tok.TokenType != "" {
+		if err := checkTokenType(tok.TokenType); err != nil {
+			return nil, err
+		}
+	}
+	return tok, nil
+}
+
+// checkTokenType returns an error if t is not a supported token type. Only
+// bearer tokens are supported, but token endpoints vary in how they spell
+// the type, so the comparison is case-insensitive.
+func checkTokenType(t string) error {
+	if !strings.EqualFold(t, "Bearer") {
+		return errors.E(errors.Invalid, errors.Errorf("unsupported token type %q, need Bearer", t))
+	}
+	return nil
+}
+
+// fileTokenSource is an oauth2.TokenSource which writes every new token
+// obtained from the underlying source to a file.
+type fileTokenSource struct {
+	src  oauth2.TokenSource
+	name string
+
+	mu   sync.Mutex
+	last *oauth2.Token // the last token written or read.
+}
+
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && s.last.AccessToken == tok.AccessToken {
+		return tok, nil
+	}
+	s.last = tok
+	if err := writeTokenFile(s.name, tok); err != nil {
+		// The token is still good, it just won't survive a restart.
+		log.Error.Printf("cloud/storage/drive: couldn't save refreshed token: %v", err)
+	}
+	return tok, nil
+}
+
+// writeTokenFile atomically replaces the named file with the JSON encoding
+// of the token.
+func writeTokenFile(name string, tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
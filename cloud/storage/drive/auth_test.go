@@ -0,0 +1,330 @@
+package drive
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"drive.upspin.io/config"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+func TestTokenFile(t *testing.T) {
+	want := &oauth2.Token{
+		AccessToken:  "access",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Date(2017, 10, 12, 9, 45, 38, 0, time.UTC),
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "token.json")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := token(&storage.Opts{Opts: map[string]string{"tokenFile": file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got token %+v, want %+v", got, want)
+	}
+
+	_, err = token(&storage.Opts{Opts: map[string]string{
+		"tokenFile":   file,
+		"accessToken": "access",
+	}})
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("got error %v, want Invalid", err)
+	}
+}
+
+func TestFileTokenSource(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token.json")
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh"}
+	if err := writeTokenFile(file, old); err != nil {
+		t.Fatal(err)
+	}
+	// The current token is not written again.
+	ts := &fileTokenSource{src: oauth2.StaticTokenSource(old), name: file, last: old}
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("token file was rewritten for an unchanged token")
+	}
+
+	// A refreshed token is written.
+	fresh := &oauth2.Token{AccessToken: "fresh", RefreshToken: "refresh"}
+	ts.src = oauth2.StaticTokenSource(fresh)
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tokenFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "fresh" {
+		t.Errorf("got access token %q in file, want %q", got.AccessToken, "fresh")
+	}
+
+	// Failing to write the token is not fatal.
+	ts.name = filepath.Join(file, "not-a-dir", "token.json")
+	ts.src = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "fresher"})
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != "fresher" {
+		t.Errorf("got token %v and error %v, want fresher token", tok, err)
+	}
+}
+
+func TestServiceAccountKey(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "key.json")
+	data := `{
+		"type": "service_account",
+		"client_email": "upspin@example.iam.gserviceaccount.com",
+		"private_key": "not checked until a token is requested",
+		"token_uri": "https://oauth2.googleapis.com/token"
+	}`
+	if err := ioutil.WriteFile(key, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	o := &storage.Opts{Opts: map[string]string{"serviceAccountKey": key}}
+	if _, err := httpClient(ctx, o, "appDataFolder"); err != nil {
+		t.Fatal(err)
+	}
+	o.Opts["refreshToken"] = "refresh"
+	if _, err := httpClient(ctx, o, "appDataFolder"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got error %v, want Invalid", err)
+	}
+}
+
+func TestMissingTokenOpts(t *testing.T) {
+	all := map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       "2017-10-12T09:45:38+02:00",
+	}
+	// Omit every non-empty combination of the token options.
+	for mask := 1; mask < 1<<uint(len(tokenKeys)); mask++ {
+		opts := make(map[string]string)
+		var want []string
+		for i, k := range tokenKeys {
+			if mask&(1<<uint(i)) != 0 {
+				want = append(want, k)
+			} else {
+				opts[k] = all[k]
+			}
+		}
+		_, err := New(&storage.Opts{Opts: opts})
+		if err == nil {
+			t.Errorf("missing %q: got no error", want)
+			continue
+		}
+		if !errors.Is(errors.Internal, err) {
+			t.Errorf("missing %q: got error %v, want Internal", want, err)
+		}
+		if got := missingOpts(err); !reflect.DeepEqual(got, want) {
+			t.Errorf("missing %q: got error %v reporting %q", want, err, got)
+		}
+		if !IsMissingOpts(err) {
+			t.Errorf("missing %q: IsMissingOpts(%v) = false, want true", want, err)
+		}
+	}
+	if _, err := New(&storage.Opts{Opts: all}); err != nil {
+		t.Errorf("got error %v with all options set", err)
+	}
+	if IsMissingOpts(errors.E(errors.Internal, errors.Str("boom"))) {
+		t.Errorf("IsMissingOpts reports an unrelated error")
+	}
+	if err := (&MissingOptsError{Missing: []string{"expiry"}}).Unwrap(); err != ErrTokenOpts {
+		t.Errorf("MissingOptsError unwraps to %v, want ErrTokenOpts", err)
+	}
+}
+
+// missingOpts returns the options reported missing by a *MissingOptsError
+// wrapped in err.
+func missingOpts(err error) []string {
+	for {
+		switch e := err.(type) {
+		case *errors.Error:
+			err = e.Err
+		case *MissingOptsError:
+			return e.Missing
+		default:
+			return nil
+		}
+	}
+}
+
+func TestTokenType(t *testing.T) {
+	for _, tt := range []struct {
+		typ string
+		ok  bool
+	}{
+		{"Bearer", true},
+		{"bearer", true},
+		{"BEARER", true},
+		{"bearer ", false},
+		{"Basic", false},
+		{"", false},
+	} {
+		_, err := token(&storage.Opts{Opts: map[string]string{
+			"accessToken":  "access",
+			"tokenType":    tt.typ,
+			"refreshToken": "refresh",
+			"expiry":       "2017-10-12T09:45:38+02:00",
+		}})
+		if tt.ok && err != nil {
+			t.Errorf("token type %q: got error %v", tt.typ, err)
+		}
+		if !tt.ok && !errors.Is(errors.Invalid, err) {
+			t.Errorf("token type %q: got error %v, want Invalid", tt.typ, err)
+		}
+	}
+}
+
+func TestExpiryError(t *testing.T) {
+	const bad = "2017-10-12 09:45:38"
+	_, err := token(&storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       bad,
+	}})
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, want := range []string{bad, "RFC3339", "cannot parse"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestOAuthConfig(t *testing.T) {
+	cfg, err := oauthConfig(&storage.Opts{Opts: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, config.OAuth2) {
+		t.Errorf("got config %+v without overrides, want %+v", cfg, config.OAuth2)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			t.Errorf("unexpected token request: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer srv.Close()
+	cfg, err = oauthConfig(&storage.Opts{Opts: map[string]string{
+		"authURL":  srv.URL + "/auth",
+		"tokenURL": srv.URL + "/token",
+		"scopes":   drive.DriveAppdataScope + ", " + drive.DriveFileScope,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Endpoint.AuthURL != srv.URL+"/auth" || cfg.Endpoint.TokenURL != srv.URL+"/token" {
+		t.Errorf("got endpoint %+v", cfg.Endpoint)
+	}
+	if want := []string{drive.DriveAppdataScope, drive.DriveFileScope}; !reflect.DeepEqual(cfg.Scopes, want) {
+		t.Errorf("got scopes %q, want %q", cfg.Scopes, want)
+	}
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	tok, err := cfg.TokenSource(context.Background(), expired).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "new" {
+		t.Errorf("got access token %q, want %q", tok.AccessToken, "new")
+	}
+
+	for _, opts := range []map[string]string{
+		{"authURL": "not a url"},
+		{"tokenURL": "/relative"},
+		{"scopes": " , "},
+	} {
+		if _, err := oauthConfig(&storage.Opts{Opts: opts}); !errors.Is(errors.Invalid, err) {
+			t.Errorf("oauthConfig(%v): got error %v, want Invalid", opts, err)
+		}
+	}
+}
+
+func TestOptsFromToken(t *testing.T) {
+	want := &oauth2.Token{
+		AccessToken:  "access",
+		TokenType:    "bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	opts := OptsFromToken(want)
+	got, err := token(&storage.Opts{Opts: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || !got.Expiry.Equal(want.Expiry) || got.Type() != "Bearer" {
+		t.Errorf("got token %+v, want %+v", got, want)
+	}
+
+	auth := make(chan string, 1)
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		auth <- r.Header.Get("Authorization")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"files": []}`)),
+			Request:    r,
+		}, nil
+	})
+	s, err := NewWithOptions(&storage.Opts{Opts: opts}, WithTransport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.(*driveImpl).Exists("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-auth; got != "Bearer access" {
+		t.Errorf("got Authorization %q, want %q", got, "Bearer access")
+	}
+}
+
+func TestScopesOrigin(t *testing.T) {
+	tests := []struct {
+		opts  map[string]string
+		space string
+		want  string
+	}{
+		{map[string]string{"scopes": drive.DriveFileScope}, "appDataFolder", "scopes option requested " + drive.DriveFileScope},
+		{map[string]string{"serviceAccountKey": "key.json"}, "appDataFolder", "domain-wide delegation"},
+		{map[string]string{"serviceAccountKey": "key.json"}, "drive", drive.DriveScope},
+		{map[string]string{"refreshToken": "t"}, "appDataFolder", config.OAuth2.Scopes[0]},
+	}
+	for _, tt := range tests {
+		got := scopesOrigin(&storage.Opts{Opts: tt.opts}, tt.space)
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("scopesOrigin(%v, %q) = %q, want it to contain %q", tt.opts, tt.space, got, tt.want)
+		}
+	}
+}
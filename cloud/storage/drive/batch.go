@@ -0,0 +1,209 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// BatchConcurrency holds the default number of refs processed concurrently
+// by the batch operations. It is kept modest to respect Drive's quotas and
+// may be overridden using the "batchConcurrency" option.
+const BatchConcurrency = 4
+
+// BatchError is returned by the batch operations when some refs failed.
+type BatchError struct {
+	// Errs holds the error for each failed ref.
+	Errs map[string]error
+}
+
+func (e *BatchError) Error() string {
+	refs := make([]string, 0, len(e.Errs))
+	for ref := range e.Errs {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	msgs := make([]string, len(refs))
+	for i, ref := range refs {
+		msgs[i] = fmt.Sprintf("%q: %v", ref, e.Errs[ref])
+	}
+	return fmt.Sprintf("%d refs failed: %s", len(refs), strings.Join(msgs, "; "))
+}
+
+// PutBatch stores all the given contents, keyed by ref, uploading up to
+// the configured number of them concurrently. Each ref is stored as by Put.
+// If any of them fail, it returns a *BatchError reporting which.
+func (d *driveImpl) PutBatch(entries map[string][]byte) error {
+	refs := make([]string, 0, len(entries))
+	for ref := range entries {
+		refs = append(refs, ref)
+	}
+	return d.batch(refs, func(ref string) error {
+		return d.Put(ref, entries[ref])
+	})
+}
+
+// DeleteBatch deletes all the given refs, deleting up to the configured
+// number of them concurrently. Each ref is deleted as by Delete. If any of
+// them fail, it returns a *BatchError reporting which.
+func (d *driveImpl) DeleteBatch(refs []string) error {
+	return d.batch(refs, d.Delete)
+}
+
+// ExistsBatch reports which of the given refs are stored, checking up to
+// the configured number of them concurrently. Each ref is checked as by
+// Exists, using the cache where possible. If any of the checks fail, it
+// returns a *BatchError reporting which, along with the results of the
+// others.
+func (d *driveImpl) ExistsBatch(refs []string) (map[string]bool, error) {
+	var mu sync.Mutex
+	exists := make(map[string]bool, len(refs))
+	err := d.batch(refs, func(ref string) error {
+		ok, err := d.Exists(ref)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		exists[ref] = ok
+		mu.Unlock()
+		return nil
+	})
+	return exists, err
+}
+
+// DeleteByPrefix deletes all the files whose name starts with the given
+// prefix, deleting up to the configured number of them concurrently, and
+// returns the number of files deleted. If any of them fail, the error holds
+// a *BatchError keyed by file ID.
+func (d *driveImpl) DeleteByPrefix(prefix string) (int, error) {
+	const op = "cloud/storage/drive.DeleteByPrefix"
+	return d.deleteByPrefix(context.Background(), op, prefix, nil)
+}
+
+// Prune is like DeleteByPrefix but takes a context, whose cancellation stops
+// the deletions, and reports its progress to onProgress, if not nil. The
+// number of matching files is reported first, with no file deleted, then the
+// number deleted so far after each file is handled. Files which were already
+// deleted by another client are not counted, so the final count may be less
+// than the total. If ctx is canceled, Prune returns the number of files
+// deleted until then along with an error of kind errors.IO.
+func (d *driveImpl) Prune(ctx context.Context, prefix string, onProgress func(deleted, total int)) (int, error) {
+	const op = "cloud/storage/drive.Prune"
+	return d.deleteByPrefix(ctx, op, prefix, onProgress)
+}
+
+// deleteByPrefix implements DeleteByPrefix and Prune on behalf of op.
+func (d *driveImpl) deleteByPrefix(ctx context.Context, op, prefix string, onProgress func(deleted, total int)) (int, error) {
+	if err := d.checkOpen(op); err != nil {
+		return 0, err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return 0, err
+	}
+	if prefix == "" {
+		return 0, errors.E(op, errors.Invalid, errors.Str("empty prefix would delete all files"))
+	}
+	q := fmt.Sprintf("name contains '%s'", queryEscaper.Replace(prefix))
+	files, err := d.listAll(ctx, q, "id, name")
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, errors.E(op, errors.IO, ctx.Err())
+		}
+		return 0, errors.E(op, errKind(err), err)
+	}
+	names := make(map[string]string)
+	var ids []string
+	for _, f := range files {
+		// Drive's contains operator also matches the prefixes of the
+		// words within a name.
+		if strings.HasPrefix(f.Name, prefix) {
+			names[f.Id] = f.Name
+			ids = append(ids, f.Id)
+		}
+	}
+	if onProgress == nil {
+		onProgress = func(int, int) {}
+	}
+	onProgress(0, len(ids))
+	var (
+		mu      sync.Mutex
+		removed int
+	)
+	err = d.batch(ids, func(id string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := d.deleteFile(ctx, names[id], id)
+		// The callback is called with mu held, so that the counts it
+		// is given never decrease.
+		mu.Lock()
+		defer mu.Unlock()
+		removed += n
+		onProgress(removed, len(ids))
+		return err
+	})
+	if ctx.Err() != nil {
+		return removed, errors.E(op, errors.IO, ctx.Err())
+	}
+	if err != nil {
+		return removed, errors.E(op, errKind(err), err)
+	}
+	return removed, nil
+}
+
+// batch calls fn for each of the refs, running up to d.concurrency calls
+// concurrently. It returns a *BatchError holding the errors returned by fn,
+// if any.
+func (d *driveImpl) batch(refs []string, fn func(ref string) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(map[string]error)
+		work = make(chan string)
+	)
+	n := d.concurrency
+	if n > len(refs) {
+		n = len(refs)
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range work {
+				if err := fn(ref); err != nil {
+					mu.Lock()
+					errs[ref] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, ref := range refs {
+		work <- ref
+	}
+	close(work)
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BatchError{Errs: errs}
+	}
+	return nil
+}
+
+// batchOpts sets the concurrency of the batch operations of d from the
+// options.
+func (d *driveImpl) batchOpts(o *storage.Opts) error {
+	concurrency, err := intOpt(o, "batchConcurrency", BatchConcurrency)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return errors.Errorf("batchConcurrency must be positive, got %d", concurrency)
+	}
+	d.concurrency = concurrency
+	return nil
+}
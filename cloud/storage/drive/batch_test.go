@@ -0,0 +1,196 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestPutBatch(t *testing.T) {
+	d, f := newTestDrive(t)
+	entries := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		entries[fmt.Sprintf("ref%d", i)] = []byte(fmt.Sprintf("data%d", i))
+	}
+	f.add("ref3", []byte("old"))
+	if err := d.PutBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	for ref, data := range entries {
+		if ids := f.named(ref); len(ids) != 1 {
+			t.Errorf("got %d files named %s, want 1", len(ids), ref)
+		}
+		got, err := d.Download(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(data) {
+			t.Errorf("got %q for %s, want %q", got, ref, data)
+		}
+	}
+}
+
+func TestPutBatchError(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.fail = func(method string, r *http.Request) int {
+		if method == "list" && strings.Contains(r.URL.Query().Get("q"), "bad") {
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+	err := d.PutBatch(map[string][]byte{
+		"good1": []byte("data"),
+		"bad":   []byte("data"),
+		"good2": []byte("data"),
+	})
+	e, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("got error %v, want *BatchError", err)
+	}
+	if len(e.Errs) != 1 || e.Errs["bad"] == nil {
+		t.Errorf("got errors %v, want one for ref bad", e.Errs)
+	}
+	if len(f.named("good1")) != 1 || len(f.named("good2")) != 1 {
+		t.Errorf("good refs were not stored")
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	d, f := newTestDrive(t)
+	var refs []string
+	for i := 0; i < 10; i++ {
+		ref := fmt.Sprintf("ref%d", i)
+		if err := d.Put(ref, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	f.add("keep", []byte("data"))
+	if err := d.DeleteBatch(append(refs, "missing")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if ids := f.named(ref); len(ids) != 0 {
+			t.Errorf("%s was not deleted", ref)
+		}
+		if _, ok := d.cache.Get(ref); ok {
+			t.Errorf("%s is still cached", ref)
+		}
+	}
+	if ids := f.named("keep"); len(ids) != 1 {
+		t.Errorf("unrelated file was deleted")
+	}
+}
+
+func TestExistsBatch(t *testing.T) {
+	d, f := newTestDrive(t)
+	want := map[string]bool{"missing": false, "uncached": true}
+	for i := 0; i < 10; i++ {
+		ref := fmt.Sprintf("ref%d", i)
+		if err := d.Put(ref, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		want[ref] = true
+	}
+	f.add("uncached", []byte("data"))
+	refs := make([]string, 0, len(want))
+	for ref := range want {
+		refs = append(refs, ref)
+	}
+	lists := f.count("list")
+	got, err := d.ExistsBatch(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Only the refs missing from the cache are looked up.
+	if n := f.count("list") - lists; n != 2 {
+		t.Errorf("got %d lists, want 2", n)
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	d, f := newTestDrive(t)
+	for i := 0; i < 10; i++ {
+		if err := d.Put(fmt.Sprintf("test-file-%d", i), []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.add("keep", []byte("data"))
+	f.add("keep test-file-", []byte("data"))
+	n, err := d.DeleteByPrefix("test-file-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("deleted %d files, want 10", n)
+	}
+	for i := 0; i < 10; i++ {
+		ref := fmt.Sprintf("test-file-%d", i)
+		if ids := f.named(ref); len(ids) != 0 {
+			t.Errorf("%s was not deleted", ref)
+		}
+		if _, ok := d.cache.Get(ref); ok {
+			t.Errorf("%s is still cached", ref)
+		}
+	}
+	if len(f.named("keep")) != 1 || len(f.named("keep test-file-")) != 1 {
+		t.Errorf("unrelated file was deleted")
+	}
+	if _, err := d.DeleteByPrefix(""); err == nil {
+		t.Errorf("DeleteByPrefix with empty prefix succeeded")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	d, f := newTestDrive(t)
+	for i := 0; i < 10; i++ {
+		if err := d.Put(fmt.Sprintf("test-file-%d", i), []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.add("keep", []byte("data"))
+	var progress [][2]int
+	n, err := d.Prune(context.Background(), "test-file-0", func(deleted, total int) {
+		progress = append(progress, [2]int{deleted, total})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][2]int{{0, 1}, {1, 1}}; n != 1 || !reflect.DeepEqual(progress, want) {
+		t.Errorf("deleted %d files with progress %v, want 1 with %v", n, progress, want)
+	}
+
+	// Cancellation stops the deletions, one file at a time.
+	d.concurrency = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n, err = d.Prune(ctx, "test-file-", func(deleted, total int) {
+		if total != 9 {
+			t.Errorf("got total %d, want 9", total)
+		}
+		if deleted == 3 {
+			cancel()
+		}
+	})
+	if !errors.Is(errors.IO, err) || n != 3 {
+		t.Errorf("got %d files deleted (error %v) after cancellation, want 3 and an IO error", n, err)
+	}
+	left := 0
+	for i := 1; i < 10; i++ {
+		left += len(f.named(fmt.Sprintf("test-file-%d", i)))
+	}
+	if left != 6 {
+		t.Errorf("got %d files left, want 6", left)
+	}
+	if len(f.named("keep")) != 1 {
+		t.Errorf("unrelated file was deleted")
+	}
+}
@@ -0,0 +1,231 @@
+package drive
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/cache"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// Cache maps refs to the entries describing the files holding them, which
+// saves listing the files on every access. Implementations must be safe for
+// concurrent use. A Cache shared by several servers storing to the same
+// folder keeps them from using the IDs of files deleted by one another.
+type Cache interface {
+	// Get returns the entry cached for the ref, if any.
+	Get(ref string) (CacheEntry, bool)
+	// Add caches the entry for the ref, replacing any previous one.
+	Add(ref string, e CacheEntry)
+	// Remove removes the entry cached for the ref, if any.
+	Remove(ref string)
+}
+
+// CacheEntry describes the file holding a ref.
+type CacheEntry struct {
+	// ID is the Drive ID of the file.
+	ID string
+	// Compressed reports whether the contents of the file are compressed.
+	Compressed bool
+	// Encrypted reports whether the contents of the file are encrypted.
+	Encrypted bool
+	// Parts is the number of files holding the contents, if they were
+	// split, of which this file holds the first part. Version tags the
+	// files holding the other parts.
+	Parts   int
+	Version string
+	// NotFound reports that no file held the ref when the entry was
+	// cached, in which case the other fields are unset. Such entries are
+	// only cached if the "negativeCacheTTL" option is set, and expire
+	// after it.
+	NotFound bool
+	// Added is the time at which the entry was cached.
+	Added time.Time
+}
+
+// newLRUCache returns a Cache holding up to size entries in memory. If size
+// is zero, nothing is cached.
+func newLRUCache(size int) Cache {
+	if size == 0 {
+		return nopCache{}
+	}
+	return lruCache{lru: cache.NewLRU(size), mu: new(sync.RWMutex)}
+}
+
+// lruCache is a Cache held in memory by an LRU.
+type lruCache struct {
+	lru *cache.LRU
+	// mu is held for writing by dump, which empties the LRU while it
+	// reads the entries, and for reading by the other methods. The LRU
+	// does its own locking otherwise.
+	mu *sync.RWMutex
+}
+
+func (c lruCache) Get(ref string) (CacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.lru.Get(ref)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return v.(CacheEntry), true
+}
+
+func (c lruCache) Add(ref string, e CacheEntry) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.lru.Add(ref, e)
+}
+
+func (c lruCache) Remove(ref string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.lru.Remove(ref)
+}
+
+// flush removes all the entries.
+func (c lruCache) flush() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for c.lru.Len() > 0 {
+		c.lru.RemoveOldest()
+	}
+}
+
+// dump returns all the entries. The LRU can't be iterated over, so they are
+// removed from the oldest and added back in the same order.
+func (c lruCache) dump() map[string]CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refs := make([]string, 0, c.lru.Len())
+	entries := make(map[string]CacheEntry, c.lru.Len())
+	for c.lru.Len() > 0 {
+		k, v := c.lru.RemoveOldest()
+		ref := k.(string)
+		refs = append(refs, ref)
+		entries[ref] = v.(CacheEntry)
+	}
+	for _, ref := range refs {
+		c.lru.Add(ref, entries[ref])
+	}
+	return entries
+}
+
+// nopCache is a Cache which caches nothing.
+type nopCache struct{}
+
+func (nopCache) Get(ref string) (CacheEntry, bool) { return CacheEntry{}, false }
+func (nopCache) Add(ref string, e CacheEntry)      {}
+func (nopCache) Remove(ref string)                 {}
+
+// FlushCache empties the cache of file IDs, so that all refs are looked up
+// again, as is needed after files were changed by other tools. Caches set
+// using WithCache, which may be shared, are left alone, but the entries
+// they hold are ignored from then on.
+func (d *driveImpl) FlushCache() {
+	d.flushed.Store(d.now())
+	if c, ok := d.cache.(lruCache); ok {
+		c.flush()
+	}
+	// The shard folders may have been changed as well.
+	d.shards.Range(func(k, _ interface{}) bool {
+		d.shards.Delete(k)
+		return true
+	})
+}
+
+// SeedCache caches the file IDs of the given refs without looking them up,
+// to warm the cache up on startup with the entries saved by DumpCache before
+// a restart. The files are assumed to hold their contents as is, not
+// compressed, encrypted or split into parts, which DumpCache ensures. Refs
+// which are already cached are left alone, as their entries can only be
+// more recent. Entries whose file was deleted since are found stale and
+// looked up again when first used, as they are after any change made by
+// another client.
+func (d *driveImpl) SeedCache(entries map[string]string) {
+	for ref, id := range entries {
+		if ref == "" || id == "" {
+			continue
+		}
+		if _, ok := d.lookupCache(ref); ok {
+			continue
+		}
+		d.addCache(ref, CacheEntry{ID: id})
+	}
+}
+
+// DumpCache returns the file IDs held by the in-memory cache, by ref, to be
+// saved and given to SeedCache after a restart. The entries of files which
+// an ID doesn't fully describe, because their contents are compressed,
+// encrypted or split into parts, are omitted, as are those of refs found not
+// to be stored and those which expired. Caches set using WithCache are
+// meant to outlive the storage and are not dumped: it returns nil.
+func (d *driveImpl) DumpCache() map[string]string {
+	c, ok := d.cache.(lruCache)
+	if !ok {
+		return nil
+	}
+	ids := make(map[string]string)
+	for ref, e := range c.dump() {
+		if e.NotFound || e.Compressed || e.Encrypted || e.Parts > 1 {
+			continue
+		}
+		if d.expired(e) || d.ignored(e) {
+			continue
+		}
+		ids[ref] = e.ID
+	}
+	return ids
+}
+
+// cacheOpts sets up the cache of d from the options, unless a cache was set
+// using WithCache.
+func (d *driveImpl) cacheOpts(o *storage.Opts) error {
+	size, err := intOpt(o, "cacheSize", LRUSize)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.Errorf("cacheSize can not be negative, got %d", size)
+	}
+	cacheTTL, err := durationOpt(o, "cacheTTL", 0)
+	if err != nil {
+		return err
+	}
+	if cacheTTL < 0 {
+		return errors.Errorf("cacheTTL can not be negative, got %v", cacheTTL)
+	}
+	notFoundTTL, err := durationOpt(o, "negativeCacheTTL", 0)
+	if err != nil {
+		return err
+	}
+	if notFoundTTL < 0 {
+		return errors.Errorf("negativeCacheTTL can not be negative, got %v", notFoundTTL)
+	}
+	if notFoundTTL > 0 && size == 0 {
+		return errors.Errorf("negativeCacheTTL can not be used with a cacheSize of 0")
+	}
+	notFoundRetries, err := intOpt(o, "notFoundRetries", 0)
+	if err != nil {
+		return err
+	}
+	if notFoundRetries < 0 {
+		return errors.Errorf("notFoundRetries can not be negative, got %d", notFoundRetries)
+	}
+	nameCheckRate, err := floatOpt(o, "nameCheckRate", 0)
+	if err != nil {
+		return err
+	}
+	if nameCheckRate < 0 || nameCheckRate > 1 {
+		return errors.Errorf("nameCheckRate must be between 0 and 1, got %v", nameCheckRate)
+	}
+	if d.cache == nil {
+		d.cache = newLRUCache(size)
+	}
+	d.cacheTTL = cacheTTL
+	d.notFoundTTL = notFoundTTL
+	d.notFoundRetries = notFoundRetries
+	d.nameCheckRate = nameCheckRate
+	return nil
+}
@@ -0,0 +1,46 @@
+package drive
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"upspin.io/errors"
+)
+
+// errClosed is returned by the methods of a driveImpl which has been closed.
+var errClosed = errors.Str("storage is closed")
+
+// Close releases the idle connections held by the storage, unless its
+// transport was provided by WithHTTPClient, in which case it belongs to the
+// caller. After Close, all other methods return an error of kind
+// errors.Invalid.
+func (d *driveImpl) Close() error {
+	const op = "cloud/storage/drive.Close"
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return errors.E(op, errors.Invalid, errClosed)
+	}
+	if d.transport != nil {
+		d.transport.CloseIdleConnections()
+	}
+	if d.replica != nil {
+		return d.replica.Close()
+	}
+	return nil
+}
+
+// checkOpen returns an error for the given op if d has been closed.
+func (d *driveImpl) checkOpen(op string) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return errors.E(op, errors.Invalid, errClosed)
+	}
+	return nil
+}
+
+// newTransport returns a transport of its own for a storage, configured as
+// http.DefaultTransport.
+func newTransport() *http.Transport {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		return t.Clone()
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
+}
@@ -0,0 +1,78 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+func TestClose(t *testing.T) {
+	d, _ := newTestDrive(t)
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("Download after Close: got error %v, want Invalid", err)
+	}
+	if err := d.Put("ref", []byte("data")); !errors.Is(errors.Invalid, err) {
+		t.Errorf("Put after Close: got error %v, want Invalid", err)
+	}
+	if err := d.Delete("ref"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("Delete after Close: got error %v, want Invalid", err)
+	}
+	if _, err := d.Exists("ref"); !errors.Is(errors.Invalid, err) {
+		t.Errorf("Exists after Close: got error %v, want Invalid", err)
+	}
+	if err := d.Close(); !errors.Is(errors.Invalid, err) {
+		t.Errorf("second Close: got error %v, want Invalid", err)
+	}
+}
+
+// idleCloser is a transport recording calls to CloseIdleConnections.
+type idleCloser struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleCloser) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestCloseTransport(t *testing.T) {
+	opts := &storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+	}}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.(*driveImpl)
+	if d.transport == nil || d.transport == http.DefaultTransport {
+		t.Errorf("storage doesn't own its transport")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transports provided by the caller are left alone.
+	rt := &idleCloser{RoundTripper: http.DefaultTransport}
+	s, err = NewWithOptions(opts, WithTransport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(*driveImpl).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rt.closed != 0 {
+		t.Errorf("Close closed the idle connections of the caller's transport")
+	}
+}
@@ -0,0 +1,53 @@
+package drive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// compressKey and compressValue make up the appProperty with which files
+// holding gzip-compressed contents are marked.
+const (
+	compressKey   = "compression"
+	compressValue = "gzip"
+)
+
+// compress returns the gzip-compressed contents read from r.
+func compress(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the contents held by the gzip-compressed b, failing if
+// they are larger than max bytes. Zero means no limit.
+func decompress(b []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Errorf("couldn't decompress contents: %v", err)
+	}
+	defer r.Close()
+	slurp, err := readLimited(r, max)
+	if err != nil {
+		return nil, errors.Errorf("couldn't decompress contents: %v", err)
+	}
+	return slurp, nil
+}
+
+// compressOpts sets whether d compresses the contents it stores from the
+// options.
+func (d *driveImpl) compressOpts(o *storage.Opts) error {
+	var err error
+	d.compress, err = boolOpt(o, "compress")
+	return err
+}
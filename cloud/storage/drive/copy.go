@@ -0,0 +1,76 @@
+package drive
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+// Copy stores a copy of the contents of srcRef under dstRef. The contents
+// are copied by Drive, without being downloaded. As with Put, any previous
+// contents of dstRef are replaced.
+func (d *driveImpl) Copy(srcRef, dstRef string) error {
+	const op = "cloud/storage/drive.Copy"
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return err
+	}
+	if err := checkRef(op, srcRef); err != nil {
+		return err
+	}
+	if err := checkRef(op, dstRef); err != nil {
+		return err
+	}
+	ctx := withTarget(context.Background(), op, dstRef)
+	src, err := d.readEntry(ctx, srcRef)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.E(op, errors.NotExist, err)
+		}
+		return errors.E(op, errKind(err), err)
+	}
+	if src.Parts > 1 {
+		return errors.E(op, errors.Invalid, errors.Errorf("%q is stored in %d parts, which can't be copied", srcRef, src.Parts))
+	}
+	old, err := d.fileEntry(ctx, dstRef)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.E(op, errKind(err), err)
+	}
+	var created *drive.File
+	err = d.retry(ctx, "files.copy", func(ctx context.Context) error {
+		parents, err := d.parentsFor(ctx, dstRef)
+		if err != nil {
+			return err
+		}
+		created, err = d.copy(src.ID, &drive.File{
+			Name:          dstRef,
+			Parents:       parents,
+			AppProperties: d.newProps(),
+		}).Fields("id").Context(ctx).Do()
+		return err
+	})
+	if isNotFound(err) {
+		d.cache.Remove(srcRef)
+		return errors.E(op, errors.NotExist, err)
+	}
+	if err != nil {
+		return errors.E(op, errKind(err), err)
+	}
+	// The copy keeps the appProperties of the source, which describe how
+	// its contents are stored.
+	d.addCache(dstRef, CacheEntry{ID: created.Id, Compressed: src.Compressed, Encrypted: src.Encrypted})
+	// As in Put, the previous copy is only deleted once the new one is in
+	// place.
+	d.removeOld(ctx, op, dstRef, old)
+	if d.publicLinks {
+		// Copies don't inherit the permissions of their source.
+		if err := d.share(ctx, created.Id); err != nil {
+			return errors.E(op, errKind(err), &SharingError{Ref: dstRef, Err: err})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package drive
+
+import (
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestCopy(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.compress = true
+	if err := d.Put("src", []byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	f.add("dst", []byte("old"))
+	if err := d.Copy("src", "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("download"); n != 0 {
+		t.Errorf("got %d downloads, want none", n)
+	}
+	if ids := f.named("dst"); len(ids) != 1 {
+		t.Errorf("got %d files named dst, want 1", len(ids))
+	}
+	for _, cached := range []bool{true, false} {
+		if !cached {
+			d.cache.Remove("dst")
+		}
+		got, err := d.Download("dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "contents" {
+			t.Errorf("got %q with cached=%v, want %q", got, cached, "contents")
+		}
+	}
+	if _, err := d.Download("src"); err != nil {
+		t.Errorf("source was lost: %v", err)
+	}
+	if err := d.Copy("missing", "dst"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v, want NotExist", err)
+	}
+}
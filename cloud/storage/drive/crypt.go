@@ -0,0 +1,87 @@
+package drive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// encryptKey and encryptValue make up the appProperty with which files
+// holding encrypted contents are marked.
+const (
+	encryptKey   = "encryption"
+	encryptValue = "aes-256-gcm"
+)
+
+// newAEAD returns the AES-GCM cipher using the given 32-byte key, which is
+// encoded in hex or in standard base64.
+func newAEAD(key string) (cipher.AEAD, error) {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Str("encryptionKey must be encoded in hex or base64")
+		}
+	}
+	if len(b) != 32 {
+		return nil, errors.Errorf("encryptionKey must hold 32 bytes, got %d", len(b))
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the contents read from r encrypted with aead, preceded by
+// the random nonce used.
+func encrypt(aead cipher.AEAD, r io.Reader) ([]byte, error) {
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// decrypt returns the contents held by b, as produced by encrypt. It fails
+// if they were not encrypted with aead or have been tampered with.
+func decrypt(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.Str("contents are encrypted but no encryptionKey is set")
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.Str("encrypted contents are too short")
+	}
+	nonce, sealed := b[:aead.NonceSize()], b[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Errorf("couldn't decrypt contents: %v", err)
+	}
+	return plain, nil
+}
+
+// cryptOpts sets the key with which d encrypts the contents it stores from
+// the options, if any.
+func (d *driveImpl) cryptOpts(o *storage.Opts) error {
+	key, ok := o.Opts["encryptionKey"]
+	if !ok {
+		return nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	d.aead = aead
+	return nil
+}
@@ -0,0 +1,76 @@
+package drive
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"upspin.io/errors"
+)
+
+var testKey = strings.Repeat("0123456789abcdef", 4)
+
+func TestNewAEAD(t *testing.T) {
+	for _, tt := range []struct {
+		key string
+		ok  bool
+	}{
+		{testKey, true},
+		{base64.StdEncoding.EncodeToString(make([]byte, 32)), true},
+		{testKey[:32], false},
+		{"not a key", false},
+	} {
+		if _, err := newAEAD(tt.key); (err == nil) != tt.ok {
+			t.Errorf("newAEAD(%q) returned error %v", tt.key, err)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	d, f := newTestDrive(t)
+	aead, err := newAEAD(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.add("plain", []byte("written before encryption"))
+	d.aead = aead
+	data := []byte("secret metadata")
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	ids := f.named("ref")
+	stored := f.file(ids[0])
+	if stored.AppProperties[encryptKey] != encryptValue {
+		t.Errorf("stored file is not marked as encrypted: %v", stored.AppProperties)
+	}
+	f.mu.Lock()
+	sealed := f.files[ids[0]].data
+	f.mu.Unlock()
+	if bytes.Contains(sealed, data) {
+		t.Errorf("contents were stored in the clear")
+	}
+	d.cache.Remove("ref")
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	got, err = d.Download("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "written before encryption" {
+		t.Errorf("got %q for unencrypted file", got)
+	}
+
+	// Tampering with the contents must be detected.
+	f.mu.Lock()
+	sealed[len(sealed)-1] ^= 1
+	f.mu.Unlock()
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v for tampered contents, want IO", err)
+	}
+}
@@ -3,18 +3,28 @@ package drive // import "drive.upspin.io/cloud/storage/drive"
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
+	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"drive.upspin.io/config"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/googleapi"
-	"upspin.io/cache"
 	"upspin.io/cloud/storage"
 	"upspin.io/errors"
+	"upspin.io/log"
 	"upspin.io/upspin"
 )
 
@@ -22,60 +32,554 @@ func init() {
 	storage.Register("drive", New)
 }
 
-// LRUSize holds the maximum number of entries that should live in the LRU cache.
-// Since it only maps file names to file IDs, 500 should be affordable to any server.
-//
-// TODO(gbbr): Make this optionally configurable via command line.
-const LRUSize = 60
+// LRUSize holds the default maximum number of entries that should live in the
+// LRU cache. Since it only maps file names to file IDs, 500 should be affordable
+// to any server. It may be overridden using the "cacheSize" option, where zero
+// disables caching.
+const LRUSize = 500
 
-// ErrTokenOpts is returned when options are missing from the storage configuration
+// UploadChunkSize holds the default size of the chunks in which large contents
+// are uploaded. Drive recommends resumable uploads for files larger than 5MB,
+// so any contents which don't fit in a single chunk are uploaded in a
+// resumable session that survives transient failures. It may be overridden
+// using the "uploadChunkSize" option.
+const UploadChunkSize = 4 << 20
+
+// RequestTimeout holds the default maximum duration of each Drive call,
+// including any transfer of contents. Uploads sent in chunks are limited
+// chunk by chunk instead. It may be overridden using the "requestTimeout"
+// option, where zero disables the limit.
+const RequestTimeout = 30 * time.Second
+
+// MaxPageSize is the maximum number of files Drive returns in a single
+// page of results. Larger values of the "pageSize" option are reduced to it.
+const MaxPageSize = 1000
+
+// ContentType holds the default MIME type with which contents are stored.
+// It may be overridden using the "contentType" option.
+const ContentType = "application/octet-stream"
+
+// tagKey and tagValue make up the appProperty with which all stored files
+// are tagged, to tell them apart from other files in a user-visible folder.
+const (
+	tagKey   = "upspin"
+	tagValue = "1"
+)
+
+// namespaceKey is the appProperty holding the namespace set by the
+// "namespace" option, which keeps apart the files of several storages
+// sharing a Drive account. Drive limits the combined size of the key and
+// value of an appProperty to 124 bytes.
+const (
+	namespaceKey       = "namespace"
+	maxNamespaceLength = 124 - len(namespaceKey)
+)
+
+// ErrTokenOpts describes the options required to build an OAuth2 token.
+// When any of them is missing, New returns a *MissingOptsError naming them,
+// which unwraps to ErrTokenOpts and is reported by IsMissingOpts.
 var ErrTokenOpts = errors.Errorf("one or more required options are missing, need: accessToken, tokenType, refreshToken, expiry")
 
+// MissingOptsError is returned by New when required options are missing from
+// the storage configuration.
+type MissingOptsError struct {
+	// Missing holds the keys of the missing options.
+	Missing []string
+}
+
+func (e *MissingOptsError) Error() string {
+	return "missing required options: " + strings.Join(e.Missing, ", ")
+}
+
+// Unwrap returns ErrTokenOpts, which describes all the required options.
+func (e *MissingOptsError) Unwrap() error {
+	return ErrTokenOpts
+}
+
+// IsMissingOpts reports whether err, as returned by New, was caused by
+// required options missing from the storage configuration.
+func IsMissingOpts(err error) bool {
+	for err != nil && err != ErrTokenOpts {
+		switch e := err.(type) {
+		case *errors.Error:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return err != nil
+}
+
+// StorageQuotaError is returned, wrapped in an *errors.Error of kind IO,
+// when a Drive call fails because the storage quota of the Drive is
+// exhausted, as IsStorageQuotaExceeded reports. Unlike rate limits, which
+// Drive reports with the same status code, it is permanent: retrying is
+// pointless until space is freed, so the call is not retried.
+type StorageQuotaError struct {
+	// Err holds the error returned by the Drive API.
+	Err *googleapi.Error
+}
+
+func (e *StorageQuotaError) Error() string {
+	return "Drive storage quota exceeded, retrying won't help: " + e.Err.Error()
+}
+
+// Unwrap returns the Drive API error, which DriveError reports.
+func (e *StorageQuotaError) Unwrap() error {
+	return e.Err
+}
+
+// DriveError returns the Drive API error which caused err, as returned by
+// the storage, if any. It allows callers to tell failures apart by status
+// code and reason, which the wrapping in *errors.Error otherwise hides.
+func DriveError(err error) (*googleapi.Error, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *googleapi.Error:
+			return e, true
+		case *errors.Error:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// IsStorageQuotaExceeded reports whether err, as returned by the storage,
+// was caused by the storage quota of the Drive being exhausted.
+func IsStorageQuotaExceeded(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *StorageQuotaError:
+			return true
+		case *errors.Error:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 // New initializes a new Storage which stores data to Google Drive.
+// It makes no network calls, so it never blocks; use Ping to check the
+// credentials, or set the "validateCredentials" option to have New check
+// them and return an error of kind errors.Permission if they are rejected.
 func New(o *storage.Opts) (storage.Storage, error) {
+	return NewWithOptions(o)
+}
+
+// NewWithOptions is like New but also applies the given options, which
+// configure what can not be expressed in storage.Opts.
+func NewWithOptions(o *storage.Opts, opts ...Option) (storage.Storage, error) {
+	return NewWithContext(context.Background(), o, opts...)
+}
+
+// NewWithToken is like New but takes the OAuth2 token granting access to
+// Drive, for callers embedding the storage rather than dialing it through
+// storage.Dial. Other settings are given as options, such as WithSpace.
+func NewWithToken(tok *oauth2.Token, opts ...Option) (storage.Storage, error) {
+	const op = "cloud/storage/drive.NewWithToken"
+	if tok == nil {
+		return nil, errors.E(op, errors.Invalid, errors.Str("nil token"))
+	}
+	return NewWithOptions(&storage.Opts{Opts: OptsFromToken(tok)}, opts...)
+}
+
+// NewWithContext is like NewWithOptions but ties the credentials to ctx:
+// tokens are refreshed using ctx, so that once it is cancelled the storage's
+// requests fail promptly instead of waiting on token refreshes.
+func NewWithContext(ctx context.Context, o *storage.Opts, opts ...Option) (storage.Storage, error) {
 	const op = "cloud/storage/drive.New"
-	a, ok := o.Opts["accessToken"]
-	if !ok {
-		return nil, errors.E(op, errors.Internal, ErrTokenOpts)
+	var cfg options
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	t, ok := o.Opts["tokenType"]
-	if !ok {
-		return nil, errors.E(op, errors.Internal, ErrTokenOpts)
+	if len(cfg.settings) > 0 {
+		m := make(map[string]string, len(o.Opts)+len(cfg.settings))
+		for k, v := range o.Opts {
+			m[k] = v
+		}
+		for k, v := range cfg.settings {
+			m[k] = v
+		}
+		o = &storage.Opts{Opts: m}
 	}
-	r, ok := o.Opts["refreshToken"]
-	if !ok {
-		return nil, errors.E(op, errors.Internal, ErrTokenOpts)
+	d := &driveImpl{
+		cache:    cfg.cache,
+		metrics:  nopMetrics{},
+		now:      cfg.now,
+		onRetry:  cfg.onRetry,
+		progress: cfg.progress,
 	}
-	e, err := time.Parse(time.RFC3339, o.Opts["expiry"])
+	if d.now == nil {
+		d.now = time.Now
+	}
+	// Each feature parses and checks its own options. Those of the space
+	// come first, as others depend on it.
+	for _, parse := range []func(*storage.Opts) error{
+		d.spaceOpts,
+		d.shareOpts,
+		d.filterOpts,
+		d.modeOpts,
+		d.cacheOpts,
+		d.staleOpts,
+		d.retryOpts,
+		d.batchOpts,
+		d.listOpts,
+		d.uploadOpts,
+		d.downloadOpts,
+		d.compressOpts,
+		d.cryptOpts,
+		d.partsOpts,
+		d.shardOpts,
+	} {
+		if err := parse(o); err != nil {
+			return nil, errors.E(op, errors.Invalid, err)
+		}
+	}
+	validate, err := boolOpt(o, "validateCredentials")
 	if err != nil {
-		return nil, errors.E(op, errors.Internal, errors.Errorf("couldn't parse expiry: ", err))
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+	// The OAuth2 transport is layered on top of the client's, which is also
+	// used to refresh tokens. Unless the caller provides one, the storage
+	// uses a transport of its own, whose idle connections Close can release
+	// without affecting other users of http.DefaultTransport.
+	base := cfg.client
+	if base == nil {
+		d.transport = newTransport()
+		base = &http.Client{Transport: d.transport}
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, base)
+	client, err := httpClient(ctx, o, d.space)
+	if err != nil {
+		return nil, errors.E(op, err)
 	}
-	ctx := context.Background()
-	client := config.OAuth2.Client(ctx, &oauth2.Token{
-		AccessToken:  a,
-		TokenType:    t,
-		RefreshToken: r,
-		Expiry:       e,
-	})
 	svc, err := drive.New(client)
 	if err != nil {
 		return nil, errors.E(op, errors.Internal, errors.Errorf("unable to retreieve drive client: %v", err))
 	}
-	return &driveImpl{
-		files: svc.Files,
-		cache: cache.NewLRU(LRUSize),
-	}, nil
+	// The application name is sent in the User-Agent header, identifying
+	// the deployment's traffic in the Cloud Console.
+	svc.UserAgent = o.Opts["appName"]
+	d.files = svc.Files
+	d.about = svc.About
+	d.permissions = svc.Permissions
+	d.scopesOrigin = scopesOrigin(o, d.space)
+	d.replica, err = newReplica(ctx, o, opts)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if validate {
+		// Expired or revoked credentials are otherwise only noticed
+		// when the storage is first used.
+		if err := d.Ping(ctx); err != nil {
+			if errors.Is(errors.Permission, err) {
+				return nil, errors.E(op, errors.Permission, errors.Errorf("credentials were rejected, re-authenticate to obtain a new token: %v", err))
+			}
+			return nil, errors.E(op, err)
+		}
+	}
+	return d, nil
+}
+
+// spaceOpts sets the space and folder in which d stores files from the
+// options.
+func (d *driveImpl) spaceOpts(o *storage.Opts) error {
+	allDrives, err := boolOpt(o, "includeAllDrives")
+	if err != nil {
+		return err
+	}
+	fallbackToRoot, err := boolOpt(o, "fallbackToRoot")
+	if err != nil {
+		return err
+	}
+	parent := o.Opts["parentFolderId"]
+	driveId := o.Opts["driveId"]
+	space, ok := o.Opts["space"]
+	if !ok {
+		space = "appDataFolder"
+		if parent != "" || driveId != "" {
+			space = "drive"
+		}
+	}
+	switch {
+	case space != "appDataFolder" && space != "drive":
+		return errors.Errorf("unknown space %q, need appDataFolder or drive", space)
+	case space == "appDataFolder" && parent != "":
+		return errors.Errorf("parentFolderId can not be used with the appDataFolder space")
+	case space == "appDataFolder" && driveId != "":
+		return errors.Errorf("driveId can not be used with the appDataFolder space")
+	case space == "appDataFolder" && allDrives:
+		return errors.Errorf("includeAllDrives can not be used with the appDataFolder space, which shared drives don't have")
+	case driveId != "" && allDrives:
+		return errors.Errorf("includeAllDrives can not be combined with driveId, which restricts listings to that shared drive")
+	}
+	d.space = space
+	d.parent = parent
+	d.driveId = driveId
+	d.allDrives = allDrives
+	d.fallbackToRoot = fallbackToRoot
+	return nil
+}
+
+// filterOpts sets which of the files in its folder d considers from the
+// options.
+func (d *driveImpl) filterOpts(o *storage.Opts) error {
+	onlyTagged, err := boolOpt(o, "onlyTagged")
+	if err != nil {
+		return err
+	}
+	namespace := o.Opts["namespace"]
+	if len(namespace) > maxNamespaceLength {
+		return errors.Errorf("namespace can not be longer than %d bytes, got %d", maxNamespaceLength, len(namespace))
+	}
+	d.onlyTagged = onlyTagged
+	d.namespace = namespace
+	return nil
+}
+
+// modeOpts sets the modes in which d changes files, and logs, from the
+// options.
+func (d *driveImpl) modeOpts(o *storage.Opts) error {
+	var err error
+	if d.readOnly, err = boolOpt(o, "readOnly"); err != nil {
+		return err
+	}
+	if d.dryRun, err = boolOpt(o, "dryRun"); err != nil {
+		return err
+	}
+	if d.softDelete, err = boolOpt(o, "softDelete"); err != nil {
+		return err
+	}
+	d.debug, err = boolOpt(o, "debug")
+	return err
+}
+
+// uploadOpts sets how d uploads contents from the options.
+func (d *driveImpl) uploadOpts(o *storage.Opts) error {
+	chunkSize, err := intOpt(o, "uploadChunkSize", UploadChunkSize)
+	if err != nil {
+		return err
+	}
+	if chunkSize < 0 {
+		return errors.Errorf("uploadChunkSize can not be negative, got %d", chunkSize)
+	}
+	updateInPlace, err := boolOpt(o, "updateInPlace")
+	if err != nil {
+		return err
+	}
+	contentType, ok := o.Opts["contentType"]
+	if !ok {
+		contentType = ContentType
+	}
+	d.chunkSize = chunkSize
+	d.updateInPlace = updateInPlace
+	d.contentType = contentType
+	return nil
+}
+
+// downloadOpts sets how d downloads contents from the options.
+func (d *driveImpl) downloadOpts(o *storage.Opts) error {
+	maxDownloadSize, err := intOpt(o, "maxDownloadSize", 0)
+	if err != nil {
+		return err
+	}
+	if maxDownloadSize < 0 {
+		return errors.Errorf("maxDownloadSize can not be negative, got %d", maxDownloadSize)
+	}
+	verify, err := boolOpt(o, "verifyChecksum")
+	if err != nil {
+		return err
+	}
+	d.maxDownloadSize = int64(maxDownloadSize)
+	d.verify = verify
+	return nil
 }
 
 var _ storage.Storage = (*driveImpl)(nil)
 
+// filesService is the subset of *drive.FilesService used by driveImpl, which
+// allows tests to intercept the calls made to the Drive API.
+type filesService interface {
+	List() *drive.FilesListCall
+	Get(fileId string) *drive.FilesGetCall
+	Create(file *drive.File) *drive.FilesCreateCall
+	Delete(fileId string) *drive.FilesDeleteCall
+	Update(fileId string, file *drive.File) *drive.FilesUpdateCall
+	Copy(fileId string, file *drive.File) *drive.FilesCopyCall
+	Export(fileId string, mimeType string) *drive.FilesExportCall
+}
+
+var _ filesService = (*drive.FilesService)(nil)
+
 // driveImpl is an implementation of Storage that connects to a Google Drive backend.
 type driveImpl struct {
+	// transport is the transport owned by the storage, on top of which the
+	// Drive API calls are authenticated, or nil if it was provided by
+	// WithHTTPClient.
+	transport *http.Transport
 	// files holds the FilesService used to interact with the Drive API.
-	files *drive.FilesService
+	files filesService
+	// about holds the AboutService used to retrieve account information.
+	about *drive.AboutService
+	// permissions holds the PermissionsService used to share files.
+	permissions *drive.PermissionsService
 	// cache will map file names to file IDs to avoid hitting the HTTP API
 	// twice on each download.
-	cache *cache.LRU
+	cache Cache
+	// cacheTTL, if positive, is the time after which cached IDs expire, so
+	// that files replaced by other clients are eventually found.
+	cacheTTL time.Duration
+	// notFoundTTL, if positive, is the time for which names not found are
+	// assumed not to exist, to avoid listing them again. They are cached
+	// as entries marked NotFound.
+	notFoundTTL time.Duration
+	// notFoundRetries is the number of times a ref being read is looked up
+	// again when it is not found, to give Drive's listings time to catch
+	// up with files just created by other clients.
+	notFoundRetries int
+	// retryAttempts is the maximum number of times a failing Drive call is
+	// attempted when the failure is transient.
+	retryAttempts int
+	// retryBaseDelay and retryMaxDelay bound the delays between attempts.
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	// chunkSize is the size of the chunks in which contents larger than it
+	// are uploaded, using a resumable upload. Contents which fit into a
+	// single chunk are uploaded in a single request. Zero disables resumable
+	// uploads altogether.
+	chunkSize int
+	// space is the Drive space in which files are stored, either
+	// "appDataFolder" or "drive".
+	space string
+	// scopesOrigin describes how the scopes of the credentials were
+	// requested, for the error reporting a missing drive.appdata scope.
+	scopesOrigin string
+	// fallbackToRoot specifies whether files are stored in the root of
+	// the user's Drive if the credentials don't grant access to the
+	// appDataFolder space. inRoot is set to 1 once that has happened.
+	fallbackToRoot bool
+	inRoot         int32
+	// parent, if set, is the ID of the folder in the "drive" space under
+	// which files are stored. Otherwise files are stored at the root of
+	// the space.
+	parent string
+	// driveId, if set, is the ID of the shared drive in which files are
+	// stored. They are then stored in its root folder, unless parent is set.
+	driveId string
+	// allDrives specifies whether files are looked up in the user's shared
+	// drives as well as in the drive space, for deployments whose files
+	// span both. New files are still created as without it: in parent, or
+	// else at the root of the user's Drive. It can't be combined with
+	// driveId, which confines the storage to one shared drive, nor with the
+	// appDataFolder space.
+	allDrives bool
+	// verify specifies whether downloaded contents are checked against the
+	// MD5 checksum computed by Drive, at the cost of an extra API call.
+	// Google-native files have no checksum and are not checked.
+	verify bool
+	// timeout limits the duration of each Drive call. Zero means no limit.
+	timeout time.Duration
+	// metrics receives measurements of the Drive API calls.
+	metrics Metrics
+	// onRetry, if not nil, is called before each retry.
+	onRetry RetryFunc
+	// progress, if not nil, is called as chunked uploads progress.
+	progress ProgressFunc
+	// counts counts the Drive API calls, as reported by Stats.
+	counts callCounts
+	// concurrency is the number of refs processed concurrently by the
+	// batch operations.
+	concurrency int
+	// sem, if set, limits the number of Drive calls in flight to its
+	// capacity, as set by the "maxConcurrency" option.
+	sem chan struct{}
+	// contentType is the MIME type with which contents are stored.
+	contentType string
+	// pageSize is the maximum number of files returned by each List call.
+	// Zero leaves it up to Drive.
+	pageSize int64
+	// onlyTagged specifies whether only files carrying the upspin tag in
+	// their appProperties are considered, so that other files stored in the
+	// same folder are never read or deleted.
+	onlyTagged bool
+	// namespace, if set, is stored in the appProperties of all files, and
+	// only files carrying it are considered.
+	namespace string
+	// softDelete specifies whether deleted files are moved to the trash,
+	// from which they can be recovered, rather than permanently deleted.
+	softDelete bool
+	// compress specifies whether contents are gzip-compressed before they
+	// are stored. Compressed files are marked as such, and are decompressed
+	// when downloaded whatever the setting.
+	compress bool
+	// aead, if set, encrypts contents before they are stored. Encrypted
+	// files are marked as such, so that files stored before encryption
+	// was enabled remain readable.
+	aead cipher.AEAD
+	// maxDownloadSize, if positive, is the maximum size of the contents
+	// read into memory by Download.
+	maxDownloadSize int64
+	// maxFileSize, if positive, is the maximum size of a stored file.
+	// Larger contents are split into parts stored in separate files and
+	// reassembled by Download.
+	maxFileSize int
+	// updateInPlace specifies whether Put replaces the contents of the
+	// file holding a ref, keeping its ID and other metadata, instead of
+	// storing them in a new file.
+	updateInPlace bool
+	// nameCheckRate is the fraction of cache hits for which the name of the
+	// cached file is checked, to notice files renamed by other clients.
+	nameCheckRate float64
+	// dryRun specifies whether Delete and the other methods deleting refs
+	// only log the files they would delete. The previous copies of refs
+	// replaced by Put are still deleted.
+	dryRun bool
+	// readOnly specifies whether the methods modifying the stored files
+	// are rejected, before making any Drive call.
+	readOnly bool
+	// debug specifies whether the Drive calls made by the main operations
+	// are logged at debug level.
+	debug bool
+	// publicLinks specifies whether stored files are made readable by
+	// anyone with their link, so that clients can fetch them without
+	// credentials. Anyone learning a file's ID can then read it.
+	publicLinks bool
+	// shardLen, if positive, is the length of the prefix of each ref
+	// naming the subfolder in which it is stored, to keep folders small
+	// in large deployments. Subfolders are created as needed and their
+	// IDs are kept in shards, by name.
+	shardLen     int
+	shards       sync.Map
+	shardLookups singleflight.Group
+	// stale tracks the cached IDs found to be stale by Download, to
+	// bypass the cache once it appears to be wholesale stale.
+	stale staleTracker
+	// closed is set to 1 by Close.
+	closed int32
+	// flushed holds the time.Time of the last FlushCache, before which
+	// cache entries are ignored.
+	flushed atomic.Value
+	// lookups deduplicates concurrent lookups of file IDs by name.
+	lookups singleflight.Group
+	// now returns the current time. It is time.Now unless replaced by
+	// WithClock, as tests do to expire cache entries deterministically.
+	now func() time.Time
+	// sleep, if set, replaces the timer on which retries wait, so that
+	// tests can check the delays without waiting for them.
+	sleep func(ctx context.Context, delay time.Duration) error
+	// replica, if set, is the storage to which Puts and Deletes are
+	// replicated, and from which refs not found are downloaded.
+	replica *driveImpl
 }
 
 func (d *driveImpl) LinkBase() (string, error) {
@@ -85,87 +589,1267 @@ func (d *driveImpl) LinkBase() (string, error) {
 	return "", upspin.ErrNotSupported
 }
 
+// LinkForRef returns a URL from which the contents of the given ref can be
+// downloaded directly from Drive. Such links are only available for files
+// stored in the "drive" space which have been shared appropriately.
+func (d *driveImpl) LinkForRef(ref string) (string, error) {
+	const op = "cloud/storage/drive.LinkForRef"
+	if err := d.checkOpen(op); err != nil {
+		return "", err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return "", err
+	}
+	ctx := withTarget(context.Background(), op, ref)
+	e, err := d.readEntry(ctx, ref)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.E(op, errors.NotExist, err)
+		}
+		return "", errors.E(op, errKind(err), err)
+	}
+	if e.Parts > 1 {
+		// The link would only serve the first part.
+		return "", errors.E(op, upspin.ErrNotSupported)
+	}
+	f, err := d.getFile(ctx, e.ID, "webContentLink")
+	if err != nil {
+		return "", errors.E(op, errKind(err), err)
+	}
+	if f.WebContentLink == "" {
+		return "", errors.E(op, upspin.ErrNotSupported)
+	}
+	return f.WebContentLink, nil
+}
+
 func (d *driveImpl) Download(ref string) ([]byte, error) {
+	return d.DownloadContext(context.Background(), ref)
+}
+
+// DownloadContext is like Download but takes a context which may be used
+// to cancel the request.
+func (d *driveImpl) DownloadContext(ctx context.Context, ref string) ([]byte, error) {
 	const op = "cloud/storage/drive.Download"
-	id, err := d.fileId(ref)
+	slurp, _, err := d.downloadRef(ctx, op, ref)
+	return slurp, err
+}
+
+// DownloadInfo describes how the contents returned by DownloadWithInfo were
+// retrieved.
+type DownloadInfo struct {
+	// CacheHit reports whether the ID of the file holding the contents was
+	// found in the cache, saving a List call.
+	CacheHit bool
+	// Bytes is the number of bytes downloaded from Drive, which may differ
+	// from the size of the contents if they are compressed or encrypted.
+	Bytes int64
+	// Calls is the number of calls made to the Drive API, including
+	// retried ones.
+	Calls int
+	// Duration is the time taken by the download.
+	Duration time.Duration
+}
+
+// DownloadWithInfo is like Download but also describes how the contents
+// were retrieved.
+func (d *driveImpl) DownloadWithInfo(ref string) ([]byte, *DownloadInfo, error) {
+	const op = "cloud/storage/drive.DownloadWithInfo"
+	return d.downloadRef(context.Background(), op, ref)
+}
+
+// downloadPrimary implements Download on behalf of op, ignoring the replica.
+func (d *driveImpl) downloadPrimary(ctx context.Context, op, ref string) ([]byte, *DownloadInfo, error) {
+	if err := d.checkOpen(op); err != nil {
+		return nil, nil, err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return nil, nil, err
+	}
+	ctx = withTarget(ctx, op, ref)
+	ctx, stats := withOpStats(ctx)
+	start := d.now()
+	info := new(DownloadInfo)
+	_, info.CacheHit = d.cachedEntry(ref)
+	e, err := d.readEntry(ctx, ref)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, errors.E(op, errors.NotExist, err)
+			return nil, nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, nil, errors.E(op, errKind(err), err)
+	}
+	slurp, err := d.download(ctx, e.ID)
+	if info.CacheHit {
+		switch {
+		case isNotFound(err):
+			d.stale.staleHit(ref, d.now())
+		case err == nil:
+			d.stale.freshHit(ref)
+		}
+	}
+	if isNotFound(err) {
+		// The cached ID is stale: the file was deleted or replaced by
+		// another client. Look it up again, once.
+		d.cache.Remove(ref)
+		e, err = d.readEntry(ctx, ref)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil, errors.E(op, errors.NotExist, err)
+			}
+			return nil, nil, errors.E(op, errKind(err), err)
 		}
-		return nil, errors.E(op, errors.IO, err)
+		slurp, err = d.download(ctx, e.ID)
+		info.CacheHit = false
+	}
+	id := e.ID
+	d.debugf("Download %q: id %s, %d bytes, took %v, error: %v", ref, id, len(slurp), d.now().Sub(start), err)
+	if isNotFound(err) {
+		// Don't let the stale ID fail every later read of the ref.
+		// Transient failures leave the cache alone.
+		d.cache.Remove(ref)
+		return nil, nil, errors.E(op, errors.NotExist, err)
 	}
-	resp, err := d.files.Get(id).Download()
 	if err != nil {
-		return nil, errors.E(op, errors.IO, err)
+		return nil, nil, errors.E(op, errKind(err), err)
+	}
+	if d.verify {
+		if err := d.checkSum(ctx, ref, id, slurp); err != nil {
+			return nil, nil, errors.E(op, errKind(err), err)
+		}
+	}
+	if e.Parts > 1 {
+		slurp, err = d.downloadParts(ctx, ref, e, slurp)
+		if err != nil {
+			return nil, nil, errors.E(op, errKind(err), err)
+		}
+	}
+	if e.Encrypted {
+		slurp, err = decrypt(d.aead, slurp)
+		if err != nil {
+			return nil, nil, errors.E(op, errKind(err), err)
+		}
 	}
+	if e.Compressed {
+		slurp, err = decompress(slurp, d.maxDownloadSize)
+		if err != nil {
+			return nil, nil, errors.E(op, errKind(err), err)
+		}
+	}
+	info.Bytes = atomic.LoadInt64(&stats.bytes)
+	info.Calls = int(atomic.LoadInt64(&stats.calls))
+	info.Duration = d.now().Sub(start)
+	return slurp, info, nil
+}
+
+// checkSum returns an error if b, the contents of the file with the given
+// ID stored under the given name, doesn't match the MD5 checksum computed
+// by Drive. Drive computes no checksum for Google-native files, whose
+// exported contents are therefore not checked.
+func (d *driveImpl) checkSum(ctx context.Context, name, id string, b []byte) error {
+	f, err := d.getFile(ctx, id, "md5Checksum")
+	if err != nil {
+		return err
+	}
+	if f.Md5Checksum == "" {
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", md5.Sum(b)); sum != f.Md5Checksum {
+		return errors.E(errors.IO, errors.Errorf("checksum mismatch for %q: got %s, want %s", name, sum, f.Md5Checksum))
+	}
+	return nil
+}
+
+// download returns the contents of the file with the given ID.
+func (d *driveImpl) download(ctx context.Context, id string) ([]byte, error) {
+	var slurp []byte
+	err := d.retry(ctx, "files.get", func(ctx context.Context) error {
+		// Downloads return the contents only, so there are no fields
+		// to select.
+		resp, err := d.get(id).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		slurp, err = d.readBody(resp)
+		return err
+	})
+	if isNotDownloadable(err) {
+		// Google Docs and the like must be exported instead.
+		slurp, err = d.export(ctx, id)
+	}
+	if s, ok := opStatsFrom(ctx); ok {
+		atomic.AddInt64(&s.bytes, int64(len(slurp)))
+	}
+	return slurp, err
+}
+
+// readBody reads and closes the body of resp, the response to a download.
+func (d *driveImpl) readBody(resp *http.Response) ([]byte, error) {
 	defer resp.Body.Close()
-	slurp, err := ioutil.ReadAll(resp.Body)
+	if d.maxDownloadSize > 0 && resp.ContentLength > d.maxDownloadSize {
+		return nil, tooLarge(d.maxDownloadSize)
+	}
+	b, err := readLimited(resp.Body, d.maxDownloadSize)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if err := checkLength(resp, len(b)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// truncatedError reports that the contents of a download were cut short,
+// as happens when the connection is lost mid-transfer. Such downloads are
+// retried.
+type truncatedError struct {
+	msg string
+}
+
+func (e *truncatedError) Error() string {
+	return "truncated download: " + e.msg
+}
+
+// truncated returns the error to report for err, which ended the reading
+// of a download, marking it as a truncation if the body ended early.
+func truncated(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return &truncatedError{msg: err.Error()}
+	}
+	return err
+}
+
+// checkLength returns an error if n, the number of bytes read from the body
+// of resp, is not the length announced by its headers, if any, so that
+// truncated contents are never returned as complete.
+func checkLength(resp *http.Response, n int) error {
+	if resp.ContentLength >= 0 && int64(n) != resp.ContentLength {
+		return &truncatedError{msg: fmt.Sprintf("got %d bytes, want %d", n, resp.ContentLength)}
+	}
+	return nil
+}
+
+// readLimited reads all of r, failing if it holds more than max bytes.
+// Zero means no limit.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
 	if err != nil {
-		return nil, errors.E(op, errors.IO, err)
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, tooLarge(max)
 	}
-	return slurp, nil
+	return b, nil
+}
+
+// tooLarge returns the error reporting contents larger than max bytes.
+func tooLarge(max int64) error {
+	return errors.Errorf("contents exceed the maximum download size of %d bytes", max)
+}
+
+// MaxDownloadSize returns the maximum size of the contents returned by
+// Download, as set by the "maxDownloadSize" option. Zero means no limit.
+// Callers reading contents by other means may use it to enforce the same
+// limit.
+func (d *driveImpl) MaxDownloadSize() int64 {
+	return d.maxDownloadSize
 }
 
 func (d *driveImpl) Put(ref string, contents []byte) error {
+	return d.PutContext(context.Background(), ref, contents)
+}
+
+// PutContext is like Put but takes a context which may be used to cancel
+// the request.
+func (d *driveImpl) PutContext(ctx context.Context, ref string, contents []byte) error {
+	return d.PutReaderContext(ctx, ref, bytes.NewReader(contents), int64(len(contents)))
+}
+
+// PutReader is like Put but streams the contents from r, which is expected
+// to yield size bytes. If the size is not known in advance, it should be -1.
+// The upload is only retried on transient failures if r is also an io.Seeker.
+func (d *driveImpl) PutReader(ref string, r io.Reader, size int64) error {
+	return d.PutReaderContext(context.Background(), ref, r, size)
+}
+
+// PutReaderContext is like PutReader but takes a context which may be used
+// to cancel the request.
+func (d *driveImpl) PutReaderContext(ctx context.Context, ref string, r io.Reader, size int64) error {
+	_, err := d.put(ctx, ref, r, size, d.contentType)
+	return err
+}
+
+// PutAndReturnID is like Put but also returns the Drive ID of the file
+// holding the contents.
+func (d *driveImpl) PutAndReturnID(ref string, contents []byte) (string, error) {
+	return d.put(context.Background(), ref, bytes.NewReader(contents), int64(len(contents)), d.contentType)
+}
+
+// PutWithType is like Put but stores the contents with the given MIME type,
+// instead of the one configured for the storage.
+func (d *driveImpl) PutWithType(ref string, contents []byte, contentType string) error {
+	_, err := d.put(context.Background(), ref, bytes.NewReader(contents), int64(len(contents)), contentType)
+	return err
+}
+
+// PutIfAbsent is like Put but leaves the ref alone if it is already stored.
+// It reports whether the contents were stored. Refs being content hashes,
+// this saves uploading contents which are already there. Concurrent calls
+// for the same ref may both store it, as Put would.
+func (d *driveImpl) PutIfAbsent(ref string, contents []byte) (created bool, err error) {
+	const op = "cloud/storage/drive.PutIfAbsent"
+	if err := d.checkOpen(op); err != nil {
+		return false, err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return false, err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return false, err
+	}
+	ctx := withTarget(context.Background(), op, ref)
+	_, err = d.fileId(ctx, ref)
+	switch {
+	case err == nil:
+		return false, nil
+	case !os.IsNotExist(err):
+		return false, errors.E(op, errKind(err), err)
+	}
+	if _, err := d.store(ctx, op, ref, CacheEntry{}, bytes.NewReader(contents), int64(len(contents)), d.contentType); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// maxRefLength is the maximum length in bytes of a ref. Drive accepts
+// longer names, but not all of its clients handle them well.
+const maxRefLength = 1024
+
+// checkRef returns an error for the given op if ref can't be stored as the
+// name of a Drive file: a file with an empty name could be written but
+// never found again.
+func checkRef(op, ref string) error {
+	switch {
+	case ref == "":
+		return errors.E(op, errors.Invalid, errors.Str("empty ref"))
+	case len(ref) > maxRefLength:
+		return errors.E(op, errors.Invalid, errors.Errorf("ref of %d bytes is longer than %d bytes", len(ref), maxRefLength))
+	}
+	return nil
+}
+
+// errReadOnly is the error reported when modifying a read-only storage.
+var errReadOnly = errors.Str("storage is read-only")
+
+// checkWritable returns an error for the given op if the storage is
+// read-only.
+func (d *driveImpl) checkWritable(op string) error {
+	if d.readOnly {
+		return errors.E(op, errors.Permission, errReadOnly)
+	}
+	return nil
+}
+
+// put stores the contents read from r under the given ref, with the given
+// MIME type, and returns the ID of the newly created file.
+func (d *driveImpl) put(ctx context.Context, ref string, r io.Reader, size int64, contentType string) (string, error) {
 	const op = "cloud/storage/drive.Put"
+	if err := d.checkOpen(op); err != nil {
+		return "", err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return "", err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return "", err
+	}
+	ctx = withTarget(ctx, op, ref)
+	var (
+		rs  io.ReadSeeker
+		pos int64
+	)
+	if d.replica != nil {
+		// The contents are read again to be stored in the replica.
+		var err error
+		rs, pos, size, err = rereadable(r, size)
+		if err != nil {
+			return "", errors.E(op, errors.IO, err)
+		}
+		r = rs
+	}
 	// check if file already exists
-	id, err := d.fileId(ref)
+	old, err := d.fileEntry(ctx, ref)
 	if err != nil && !os.IsNotExist(err) {
-		return errors.E(op, errors.IO, err)
+		return "", errors.E(op, errKind(err), err)
 	}
-	if id != "" {
-		// if it does, delete it to ensure uniqueness because Google Drive allows
-		// multiple files with the same name to coexist in the same folder. See:
-		// https://developers.google.com/drive/v3/reference/files#properties
-		if err := d.Delete(ref); err != nil {
-			return err
+	id, err := d.store(ctx, op, ref, old, r, size, contentType)
+	if err != nil || d.replica == nil {
+		return id, err
+	}
+	return id, d.replicatePut(ctx, op, ref, rs, pos, size, contentType)
+}
+
+// store uploads the contents read from r under the given ref on behalf of
+// op, replacing the file described by old, if any, and returns the ID of the
+// newly created file.
+func (d *driveImpl) store(ctx context.Context, op, ref string, old CacheEntry, r io.Reader, size int64, contentType string) (string, error) {
+	start := d.now()
+	props := d.newProps()
+	if d.compress {
+		b, err := compress(r)
+		if err != nil {
+			return "", errors.E(op, errKind(err), err)
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+		props[compressKey] = compressValue
+	}
+	if d.aead != nil {
+		b, err := encrypt(d.aead, r)
+		if err != nil {
+			return "", errors.E(op, errKind(err), err)
+		}
+		r, size = bytes.NewReader(b), int64(len(b))
+		props[encryptKey] = encryptValue
+	}
+	var split []byte
+	if max := int64(d.maxFileSize); max > 0 && (size < 0 || size > max) {
+		// The contents may have to be split, which requires holding
+		// them in memory.
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", errors.E(op, errors.IO, err)
+		}
+		if int64(len(b)) > max {
+			split = b
+		} else {
+			r, size = bytes.NewReader(b), int64(len(b))
+		}
+	}
+	e := CacheEntry{Compressed: d.compress, Encrypted: d.aead != nil}
+	var (
+		created *drive.File
+		err     error
+	)
+	replaced := false
+	switch {
+	case split != nil:
+		created, err = d.uploadParts(ctx, ref, split, contentType, props, &e)
+	case d.updateInPlace && old.ID != "" && old.Parts <= 1:
+		s, seekable := r.(io.Seeker)
+		var pos int64
+		if seekable {
+			pos, err = s.Seek(0, io.SeekCurrent)
+			seekable = err == nil
+		}
+		created, err = d.replace(ctx, ref, old, r, size, contentType, props)
+		replaced = err == nil
+		if seekable && isNotFound(err) {
+			// The file was deleted since its ID was cached, so the
+			// contents are stored anew.
+			d.cache.Remove(ref)
+			if _, err = s.Seek(pos, io.SeekStart); err == nil {
+				old = CacheEntry{}
+				created, err = d.upload(ctx, ref, r, size, contentType, props)
+			}
+		}
+	default:
+		created, err = d.upload(ctx, ref, r, size, contentType, props)
+	}
+	if err != nil {
+		d.debugf("Put %q: took %v, error: %v", ref, d.now().Sub(start), err)
+		return "", errors.E(op, errKind(err), err)
+	}
+	d.debugf("Put %q: id %s, replacing %q, took %v", ref, created.Id, old.ID, d.now().Sub(start))
+	e.ID = created.Id
+	d.addCache(ref, e)
+	if replaced {
+		// The file is the same, with its permissions.
+		return created.Id, nil
+	}
+	// The file existed before, so delete the old copy to ensure uniqueness
+	// because Google Drive allows multiple files with the same name to
+	// coexist in the same folder. See:
+	// https://developers.google.com/drive/v3/reference/files#properties
+	// It is only deleted once the new copy is in place, so that a failed
+	// upload never loses the previous contents.
+	d.removeOld(ctx, op, ref, old)
+	if d.publicLinks {
+		if err := d.share(ctx, created.Id); err != nil {
+			return created.Id, errors.E(op, errKind(err), &SharingError{Ref: ref, Err: err})
+		}
+	}
+	return created.Id, nil
+}
+
+// removeOld deletes the file described by old, if any, which held the
+// previous contents of ref, along with its other parts. As the new contents
+// are in place, failures are only logged.
+func (d *driveImpl) removeOld(ctx context.Context, op, ref string, old CacheEntry) {
+	if old.ID == "" {
+		return
+	}
+	if err := d.remove(ctx, old.ID); err != nil {
+		log.Error.Printf("%s: couldn't delete previous file %s for %q: %v", op, old.ID, ref, err)
+	}
+	if old.Parts > 1 {
+		if err := d.removeParts(ctx, ref, old); err != nil {
+			log.Error.Printf("%s: couldn't delete previous parts of %q: %v", op, ref, err)
+		}
+	}
+}
+
+// upload creates a file with the given name and appProperties, holding the
+// contents read from r, and returns it. Its size may be negative if unknown.
+func (d *driveImpl) upload(ctx context.Context, name string, r io.Reader, size int64, contentType string, props map[string]string) (*drive.File, error) {
+	return d.sendMedia(ctx, "files.create", name, r, size, contentType, func(ctx context.Context, opts []googleapi.MediaOption, pu googleapi.ProgressUpdater) (*drive.File, error) {
+		parents, err := d.parentsFor(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		call := d.create(&drive.File{
+			Name:          name,
+			Parents:       parents,
+			AppProperties: props,
+		}).Media(r, opts...)
+		if pu != nil {
+			call.ProgressUpdater(pu)
+		}
+		return call.Fields("id").Context(ctx).Do()
+	})
+}
+
+// replace replaces the contents of the file described by old, which holds
+// the given ref, with those read from r, and sets the given appProperties,
+// removing those describing the previous contents only. The file keeps its
+// ID and its other metadata, such as its permissions.
+func (d *driveImpl) replace(ctx context.Context, ref string, old CacheEntry, r io.Reader, size int64, contentType string, props map[string]string) (*drive.File, error) {
+	f := &drive.File{AppProperties: props}
+	for key, stale := range map[string]bool{
+		compressKey: old.Compressed && props[compressKey] == "",
+		encryptKey:  old.Encrypted && props[encryptKey] == "",
+	} {
+		if stale {
+			f.NullFields = append(f.NullFields, "AppProperties."+key)
 		}
 	}
-	call := d.files.Create(&drive.File{
-		Name:    ref,
-		Parents: []string{"appDataFolder"},
+	return d.sendMedia(ctx, "files.update", ref, r, size, contentType, func(ctx context.Context, opts []googleapi.MediaOption, pu googleapi.ProgressUpdater) (*drive.File, error) {
+		call := d.update(old.ID, f).Media(r, opts...)
+		if pu != nil {
+			call.ProgressUpdater(pu)
+		}
+		return call.Fields("id").Context(ctx).Do()
 	})
-	contentType := googleapi.ContentType("application/octet-stream")
-	_, err = call.Media(bytes.NewReader(contents), contentType).Do()
+}
+
+// sendMedia sends the contents read from r, of the given size, which may be
+// negative if unknown, to the file with the given name through the call to
+// the Drive API method made by do, which it passes the media options and
+// the progress updater to use, if any. The call is retried if the contents
+// can be read again.
+func (d *driveImpl) sendMedia(ctx context.Context, method, name string, r io.Reader, size int64, contentType string, do func(context.Context, []googleapi.MediaOption, googleapi.ProgressUpdater) (*drive.File, error)) (*drive.File, error) {
+	chunkSize := d.chunkSize
+	if size >= 0 && size <= int64(chunkSize) {
+		// No need to buffer a chunk when the contents are known to fit in one.
+		chunkSize = 0
+	}
+	opts := []googleapi.MediaOption{googleapi.ContentType(contentType), googleapi.ChunkSize(chunkSize)}
+	// The duration of a chunked upload grows with the size of the
+	// contents, so the request timeout limits each chunk instead: it is
+	// restarted whenever one is sent.
+	chunked := chunkSize > 0 && d.timeout > 0
+	if chunked {
+		ctx = withoutTimeout(ctx)
+	}
+	var idle *time.Timer
+	var pu googleapi.ProgressUpdater
+	if d.progress != nil || chunked {
+		pu = func(sent, _ int64) {
+			if idle != nil {
+				idle.Reset(d.timeout)
+			}
+			if d.progress != nil {
+				// The total is unknown to the library, which reads r
+				// as a stream.
+				d.progress(name, sent, size)
+			}
+		}
+	}
+	var f *drive.File
+	send := func(ctx context.Context) error {
+		if chunked {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(ctx)
+			defer cancel()
+			idle = time.AfterFunc(d.timeout, cancel)
+			defer idle.Stop()
+		}
+		var err error
+		f, err = do(ctx, opts, pu)
+		return err
+	}
+	s, ok := r.(io.Seeker)
+	if !ok {
+		// The contents can not be read again, so the upload can't be retried.
+		err := d.call(ctx, method, send)
+		if err != nil {
+			_, err = d.checkAppData(err)
+		}
+		return f, err
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return errors.E(op, errors.IO, err)
+		return nil, err
 	}
-	return nil
+	err = d.retry(ctx, method, func(ctx context.Context) error {
+		if _, err := s.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return send(ctx)
+	})
+	return f, err
 }
 
+// Delete deletes the given ref. Deleting a ref which is not stored is not
+// an error; use DeleteStrict to have it reported.
 func (d *driveImpl) Delete(ref string) error {
-	const op = "cloud/storage/drive.Download"
-	id, err := d.fileId(ref)
+	return d.DeleteContext(context.Background(), ref)
+}
+
+// DeleteContext is like Delete but takes a context which may be used to
+// cancel the request.
+func (d *driveImpl) DeleteContext(ctx context.Context, ref string) error {
+	const op = "cloud/storage/drive.Delete"
+	return d.deleteRef(ctx, op, ref, false)
+}
+
+// DeleteStrict is like Delete but returns an error of kind errors.NotExist
+// if the ref is not stored, as Download does.
+func (d *driveImpl) DeleteStrict(ref string) error {
+	const op = "cloud/storage/drive.DeleteStrict"
+	return d.deleteRef(context.Background(), op, ref, true)
+}
+
+// deletePrimary deletes the given ref on behalf of op, ignoring the replica.
+// If strict is set, a ref which is not stored is reported as an error.
+func (d *driveImpl) deletePrimary(ctx context.Context, op, ref string, strict bool) error {
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return err
+	}
+	ctx = withTarget(ctx, op, ref)
+	start := d.now()
+	e, err := d.fileEntry(ctx, ref)
+	id := e.ID
 	if err != nil {
 		if os.IsNotExist(err) {
+			if strict {
+				return errors.E(op, errors.NotExist, err)
+			}
 			// nothing to delete
 			return nil
 		}
-		return errors.E(op, errors.IO, err)
+		return errors.E(op, errKind(err), err)
+	}
+	if d.dryRun {
+		log.Info.Printf("%s: dry run: would delete %q (%s)", op, ref, id)
+		return nil
+	}
+	if e.Parts > 1 {
+		// The first part is deleted last, so that the others can still
+		// be found if this fails.
+		if err := d.removeParts(ctx, ref, e); err != nil {
+			return errors.E(op, errKind(err), err)
+		}
 	}
-	if err := d.files.Delete(id).Do(); err != nil {
-		return errors.E(op, errors.IO, err)
+	err = d.remove(ctx, id)
+	d.debugf("Delete %q: id %s, took %v, error: %v", ref, id, d.now().Sub(start), err)
+	if err != nil {
+		return errors.E(op, errKind(err), err)
 	}
 	d.cache.Remove(ref)
 	return nil
 }
 
-// fileId returns the file ID of the first file found under the given name.
-func (d *driveImpl) fileId(name string) (string, error) {
-	// try cache first
-	if id, ok := d.cache.Get(name); ok {
-		return id.(string), nil
+// Exists reports whether the given ref is stored, without downloading it.
+func (d *driveImpl) Exists(ref string) (bool, error) {
+	const op = "cloud/storage/drive.Exists"
+	if err := d.checkOpen(op); err != nil {
+		return false, err
 	}
-	q := fmt.Sprintf("name='%s'", name)
-	call := d.files.List().Spaces("appDataFolder").Q(q).Fields("files(id)")
-	r, err := call.Do()
-	if err != nil {
+	if err := checkRef(op, ref); err != nil {
+		return false, err
+	}
+	_, err := d.fileId(withTarget(context.Background(), op, ref), ref)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, errors.E(op, errKind(err), err)
+	}
+	return true, nil
+}
+
+// ResolveID returns the Drive ID of the file holding the given ref, for use
+// with other Drive tools. For contents split into parts, it is the file
+// holding the first part. It returns an error of kind errors.NotExist if
+// the ref is not stored.
+func (d *driveImpl) ResolveID(ref string) (string, error) {
+	const op = "cloud/storage/drive.ResolveID"
+	if err := d.checkOpen(op); err != nil {
+		return "", err
+	}
+	if err := checkRef(op, ref); err != nil {
 		return "", err
 	}
-	if len(r.Files) == 0 {
-		return "", os.ErrNotExist
+	id, err := d.fileId(withTarget(context.Background(), op, ref), ref)
+	switch {
+	case os.IsNotExist(err):
+		return "", errors.E(op, errors.NotExist, err)
+	case err != nil:
+		return "", errors.E(op, errKind(err), err)
 	}
-	id := r.Files[0].Id
-	d.cache.Add(name, id)
 	return id, nil
 }
+
+// RefInfo holds metadata about a stored ref.
+type RefInfo struct {
+	// Size is the size of the contents in bytes.
+	Size int64
+	// ModTime is the time at which the contents were last modified.
+	ModTime time.Time
+	// MD5 is the hex-encoded MD5 checksum of the contents, as computed by Drive.
+	// It is empty for contents split into several parts.
+	MD5 string
+}
+
+// Stat returns metadata about the given ref, without downloading it.
+func (d *driveImpl) Stat(ref string) (*RefInfo, error) {
+	const op = "cloud/storage/drive.Stat"
+	if err := d.checkOpen(op); err != nil {
+		return nil, err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return nil, err
+	}
+	ctx := withTarget(context.Background(), op, ref)
+	e, err := d.readEntry(ctx, ref)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, errors.E(op, errKind(err), err)
+	}
+	f, err := d.getFile(ctx, e.ID, "size", "modifiedTime", "md5Checksum")
+	if err != nil {
+		return nil, errors.E(op, errKind(err), err)
+	}
+	mod, err := time.Parse(time.RFC3339, f.ModifiedTime)
+	if err != nil {
+		return nil, errors.E(op, errors.IO, errors.Errorf("couldn't parse modifiedTime: %v", err))
+	}
+	info := &RefInfo{Size: f.Size, ModTime: mod, MD5: f.Md5Checksum}
+	if e.Parts > 1 {
+		parts, err := d.partFiles(ctx, ref, e, "size")
+		if err != nil {
+			return nil, errors.E(op, errKind(err), err)
+		}
+		for i, p := range parts {
+			if p == nil {
+				return nil, errors.E(op, errors.IO, errors.Errorf("part %d of %d of %q is missing", i+1, e.Parts, ref))
+			}
+			info.Size += p.Size
+		}
+		info.MD5 = ""
+	}
+	return info, nil
+}
+
+// fileId returns the file ID of the newest file found under the given name.
+func (d *driveImpl) fileId(ctx context.Context, name string) (string, error) {
+	e, err := d.fileEntry(ctx, name)
+	return e.ID, err
+}
+
+// fileEntry is like fileId but returns the cache entry describing the file.
+func (d *driveImpl) fileEntry(ctx context.Context, name string) (CacheEntry, error) {
+	// try cache first
+	if e, ok := d.lookupCache(name); ok {
+		if e.NotFound {
+			d.debugf("fileId %q: negative cache hit", name)
+			return CacheEntry{}, os.ErrNotExist
+		}
+		if d.nameCheckRate == 0 || rand.Float64() >= d.nameCheckRate || d.checkName(ctx, name, e.ID) {
+			d.debugf("fileId %q: cache hit, id %s", name, e.ID)
+			return e, nil
+		}
+	}
+	// Concurrent lookups of the same name share a single List call, made
+	// on a context of its own so that a caller giving up doesn't fail the
+	// others. Each caller waits until its own context is done.
+	start := d.now()
+	ch := d.lookups.DoChan(name, func() (interface{}, error) {
+		return d.sharedLookup(name)
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return CacheEntry{}, ctx.Err()
+	}
+	l, _ := res.Val.(lookup)
+	if s, ok := opStatsFrom(ctx); ok {
+		atomic.AddInt64(&s.calls, l.calls)
+	}
+	d.debugf("fileId %q: cache miss, id %s, took %v, error: %v", name, l.entry.ID, d.now().Sub(start), res.Err)
+	if res.Err != nil {
+		return CacheEntry{}, res.Err
+	}
+	return l.entry, nil
+}
+
+// lookupOp names the lookups shared by concurrent operations in the
+// reports of their retries.
+const lookupOp = "cloud/storage/drive.lookup"
+
+// lookup is the result of a shared lookup.
+type lookup struct {
+	entry CacheEntry
+	// calls is the number of Drive calls made by the lookup, which are
+	// counted by each of the operations sharing it.
+	calls int64
+}
+
+// sharedLookup looks the given name up on behalf of all the operations
+// looking it up concurrently. The lookup is limited by the request timeout
+// rather than by the context of any of them.
+func (d *driveImpl) sharedLookup(name string) (interface{}, error) {
+	ctx := withTarget(context.Background(), lookupOp, name)
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	ctx, stats := withOpStats(ctx)
+	e, err := d.lookupId(ctx, name)
+	return lookup{entry: e, calls: atomic.LoadInt64(&stats.calls)}, err
+}
+
+// checkName reports whether the file with the given ID, cached as holding
+// the given name, still does. Files renamed or deleted by other clients are
+// evicted from the cache. The cached entry is trusted if the file can't be
+// retrieved.
+func (d *driveImpl) checkName(ctx context.Context, name, id string) bool {
+	f, err := d.getFile(ctx, id, "name")
+	switch {
+	case isNotFound(err):
+		d.debugf("fileId %q: cached file %s no longer exists", name, id)
+	case err != nil:
+		d.debugf("fileId %q: couldn't check the name of cached file %s: %v", name, id, err)
+		return true
+	case f.Name != name:
+		log.Error.Printf("cloud/storage/drive: cached file %s of %q was renamed to %q by another client", id, name, f.Name)
+	default:
+		return true
+	}
+	d.cache.Remove(name)
+	return false
+}
+
+// readEntry is like fileEntry but, if the notFoundRetries option is set,
+// looks the name up again a few times before reporting that it does not
+// exist. Drive's listings are eventually consistent, so a file just created
+// by another client may not be found right away. It is used when reading
+// refs, which are expected to exist.
+func (d *driveImpl) readEntry(ctx context.Context, name string) (CacheEntry, error) {
+	e, err := d.fileEntry(ctx, name)
+	for attempt := 1; attempt <= d.notFoundRetries && os.IsNotExist(err); attempt++ {
+		t := time.NewTimer(d.backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return CacheEntry{}, ctx.Err()
+		}
+		d.removeNotFound(name)
+		e, err = d.fileEntry(ctx, name)
+	}
+	return e, err
+}
+
+// lookupId lists the files with the given name to find the newest one, and
+// adds it to the cache.
+func (d *driveImpl) lookupId(ctx context.Context, name string) (CacheEntry, error) {
+	files, err := d.listNamed(ctx, name, "id, createdTime, appProperties")
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	if len(files) == 0 {
+		if d.notFoundTTL > 0 {
+			d.addCache(name, CacheEntry{NotFound: true})
+		}
+		return CacheEntry{}, os.ErrNotExist
+	}
+	if len(files) > 1 {
+		log.Info.Printf("cloud/storage/drive: found %d files named %q, using the newest", len(files), name)
+	}
+	sortNewestFirst(files)
+	e := fileCacheEntry(files[0])
+	d.addCache(name, e)
+	return e, nil
+}
+
+// fileCacheEntry returns the cache entry describing f, whose appProperties
+// must have been retrieved.
+func fileCacheEntry(f *drive.File) CacheEntry {
+	e := CacheEntry{
+		ID:         f.Id,
+		Compressed: f.AppProperties[compressKey] == compressValue,
+		Encrypted:  f.AppProperties[encryptKey] == encryptValue,
+		Version:    f.AppProperties[versionKey],
+	}
+	e.Parts, _ = strconv.Atoi(f.AppProperties[partsKey])
+	return e
+}
+
+// addCache caches e as the entry of the given name.
+func (d *driveImpl) addCache(name string, e CacheEntry) {
+	e.Added = d.now()
+	d.cache.Add(name, e)
+}
+
+// cachedId returns the cached file ID of the given name, if any.
+func (d *driveImpl) cachedId(name string) (string, bool) {
+	e, ok := d.cachedEntry(name)
+	return e.ID, ok
+}
+
+// cachedEntry returns the cached entry of the file holding the given name,
+// if any.
+func (d *driveImpl) cachedEntry(name string) (CacheEntry, bool) {
+	e, ok := d.lookupCache(name)
+	if !ok || e.NotFound {
+		return CacheEntry{}, false
+	}
+	return e, true
+}
+
+// lookupCache returns the cached entry of the given name, if any, which may
+// record that the name was not found. Entries older than the cache TTL, or
+// than the negative cache TTL for those recording that the name was not
+// found, are evicted.
+func (d *driveImpl) lookupCache(name string) (CacheEntry, bool) {
+	e, ok := d.cache.Get(name)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	if d.expired(e) {
+		d.cache.Remove(name)
+		return CacheEntry{}, false
+	}
+	if d.ignored(e) {
+		return CacheEntry{}, false
+	}
+	return e, true
+}
+
+// expired reports whether the cache entry e is older than the cache TTL, or
+// than the negative cache TTL if it records that the name was not found.
+func (d *driveImpl) expired(e CacheEntry) bool {
+	age := d.now().Sub(e.Added)
+	return (d.cacheTTL > 0 && age >= d.cacheTTL) || (e.NotFound && age >= d.notFoundTTL)
+}
+
+// ignored reports whether the cache entry e must not be used, because it
+// was added before the cache was flushed or found to be stale.
+func (d *driveImpl) ignored(e CacheEntry) bool {
+	if flushed, ok := d.flushed.Load().(time.Time); ok && e.Added.Before(flushed) {
+		return true
+	}
+	return d.stale.ignore(e.Added, d.now())
+}
+
+// removeNotFound evicts the entry of the given name if it records that the
+// name was not found.
+func (d *driveImpl) removeNotFound(name string) {
+	if e, ok := d.cache.Get(name); ok && e.NotFound {
+		d.cache.Remove(name)
+	}
+}
+
+// debugf logs the given message at debug level if debugging is enabled.
+func (d *driveImpl) debugf(format string, args ...interface{}) {
+	if d.debug {
+		log.Debug.Printf("cloud/storage/drive: "+format, args...)
+	}
+}
+
+// listAll returns the given fields of all the files stored by d which match
+// the query q, going through all the pages of results.
+func (d *driveImpl) listAll(ctx context.Context, q, fields string) ([]*drive.File, error) {
+	if d.shardLen > 0 {
+		return d.listSharded(ctx, q, fields)
+	}
+	return d.listPages(ctx, fields, func() *drive.FilesListCall { return d.list(q) })
+}
+
+// listNamed returns the given fields of the files stored under the given
+// name.
+func (d *driveImpl) listNamed(ctx context.Context, name, fields string) ([]*drive.File, error) {
+	return d.listNamedIn(ctx, name, fields, false)
+}
+
+// listNamedIn is like listNamed but lists the files in the trash instead if
+// trashed is set.
+func (d *driveImpl) listNamedIn(ctx context.Context, name, fields string, trashed bool) ([]*drive.File, error) {
+	if d.shardLen > 0 {
+		return d.listShard(ctx, name, fields, trashed)
+	}
+	q := nameQuery(name)
+	return d.listPages(ctx, fields, func() *drive.FilesListCall { return d.listFiles(d.parent, q, trashed) })
+}
+
+// listPages returns the given fields of the files listed by the calls built
+// by newCall, going through all the pages of results. A new call is built
+// for each attempt, as the storage may fall back to another space.
+func (d *driveImpl) listPages(ctx context.Context, fields string, newCall func() *drive.FilesListCall) ([]*drive.File, error) {
+	f := googleapi.Field("nextPageToken, files(" + fields + ")")
+	var files []*drive.File
+	for token := ""; ; {
+		var r *drive.FileList
+		err := d.retry(ctx, "files.list", func(ctx context.Context) error {
+			var err error
+			r, err = newCall().Fields(f).PageToken(token).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, r.Files...)
+		if token = r.NextPageToken; token == "" {
+			return files, nil
+		}
+	}
+}
+
+// list returns a call listing the files stored by d which match the query q.
+// An empty query matches all files.
+func (d *driveImpl) list(q string) *drive.FilesListCall {
+	return d.listIn(d.parent, q)
+}
+
+// listIn is like list but only lists the files in the folder with the given
+// ID, if set, instead of the parent folder.
+func (d *driveImpl) listIn(folder, q string) *drive.FilesListCall {
+	// Trashed files are considered deleted.
+	return d.listFiles(folder, q, false)
+}
+
+// listFiles is like listIn but lists the files in the trash instead if
+// trashed is set.
+func (d *driveImpl) listFiles(folder, q string, trashed bool) *drive.FilesListCall {
+	clauses := []string{fmt.Sprintf("trashed = %t", trashed)}
+	if folder != "" {
+		clauses = append(clauses, fmt.Sprintf("'%s' in parents", queryEscaper.Replace(folder)))
+	}
+	if d.onlyTagged {
+		clauses = append(clauses, fmt.Sprintf("appProperties has { key='%s' and value='%s' }", tagKey, tagValue))
+	}
+	if d.namespace != "" {
+		clauses = append(clauses, fmt.Sprintf("appProperties has { key='%s' and value='%s' }", namespaceKey, queryEscaper.Replace(d.namespace)))
+	}
+	if q != "" {
+		clauses = append(clauses, q)
+	}
+	call := d.files.List().Spaces(d.currentSpace()).Q(strings.Join(clauses, " and "))
+	switch {
+	case d.driveId != "":
+		call.Corpora("drive").DriveId(d.driveId).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	case d.allDrives:
+		call.Corpora("allDrives").IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	if d.pageSize > 0 {
+		call.PageSize(d.pageSize)
+	}
+	return call
+}
+
+// newProps returns the appProperties with which new files are tagged.
+func (d *driveImpl) newProps() map[string]string {
+	props := map[string]string{tagKey: tagValue}
+	if d.namespace != "" {
+		props[namespaceKey] = d.namespace
+	}
+	return props
+}
+
+// supportsAllDrives reports whether the files of d may be stored in shared
+// drives, which calls must then declare to reach them.
+func (d *driveImpl) supportsAllDrives() bool {
+	return d.driveId != "" || d.allDrives
+}
+
+// get returns a call retrieving the file with the given ID.
+func (d *driveImpl) get(id string) *drive.FilesGetCall {
+	call := d.files.Get(id)
+	if d.supportsAllDrives() {
+		call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+// getFile returns the metadata of the file with the given ID. Only the given
+// fields are requested, to keep responses small, so the others are unset.
+func (d *driveImpl) getFile(ctx context.Context, id string, fields ...googleapi.Field) (*drive.File, error) {
+	var f *drive.File
+	err := d.retry(ctx, "files.get", func(ctx context.Context) error {
+		var err error
+		f, err = d.get(id).Fields(fields...).Context(ctx).Do()
+		return err
+	})
+	return f, err
+}
+
+// create returns a call creating the given file.
+func (d *driveImpl) create(f *drive.File) *drive.FilesCreateCall {
+	call := d.files.Create(f)
+	if d.supportsAllDrives() {
+		call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+// update returns a call updating the metadata of the file with the given ID.
+func (d *driveImpl) update(id string, f *drive.File) *drive.FilesUpdateCall {
+	call := d.files.Update(id, f)
+	if d.supportsAllDrives() {
+		call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+// copy returns a call copying the file with the given ID, applying the
+// metadata in f to the copy.
+func (d *driveImpl) copy(id string, f *drive.File) *drive.FilesCopyCall {
+	call := d.files.Copy(id, f)
+	if d.supportsAllDrives() {
+		call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+// remove deletes the file with the given ID, or moves it to the trash if
+// soft deletion is enabled.
+func (d *driveImpl) remove(ctx context.Context, id string) error {
+	if d.softDelete {
+		return d.retry(ctx, "files.update", func(ctx context.Context) error {
+			_, err := d.update(id, &drive.File{Trashed: true}).Fields("id").Context(ctx).Do()
+			return err
+		})
+	}
+	return d.retry(ctx, "files.delete", func(ctx context.Context) error {
+		return d.delete(id).Context(ctx).Do()
+	})
+}
+
+// delete returns a call permanently deleting the file with the given ID.
+func (d *driveImpl) delete(id string) *drive.FilesDeleteCall {
+	call := d.files.Delete(id)
+	if d.supportsAllDrives() {
+		call.SupportsAllDrives(true)
+	}
+	return call
+}
+
+// parents returns the parents of the files created by d.
+func (d *driveImpl) parents() []string {
+	switch {
+	case d.parent != "":
+		return []string{d.parent}
+	case d.driveId != "":
+		// The root folder of a shared drive has the drive's ID.
+		return []string{d.driveId}
+	case d.currentSpace() == "appDataFolder":
+		return []string{"appDataFolder"}
+	}
+	// The root of the user's Drive.
+	return nil
+}
+
+// currentSpace returns the Drive space in which files are stored, which is
+// the configured one unless d fell back to the root of the user's Drive.
+func (d *driveImpl) currentSpace() string {
+	if atomic.LoadInt32(&d.inRoot) != 0 {
+		return "drive"
+	}
+	return d.space
+}
+
+// checkAppData handles err, returned by a Drive call, if it shows that the
+// credentials don't grant access to the appDataFolder space. If the
+// fallbackToRoot option is set, it makes d store files in the root of the
+// user's Drive from then on and reports that the call should be made
+// again. Otherwise it returns an error explaining the required scope.
+func (d *driveImpl) checkAppData(err error) (retry bool, _ error) {
+	if d.currentSpace() != "appDataFolder" || !isScopeError(err) && !isAppDataNotFound(err) {
+		return false, err
+	}
+	if d.fallbackToRoot {
+		if atomic.CompareAndSwapInt32(&d.inRoot, 0, 1) {
+			log.Info.Printf("cloud/storage/drive: no access to the appDataFolder space, storing files in the root of the Drive: %v", err)
+		}
+		return true, err
+	}
+	msg := fmt.Sprintf("the credentials don't grant access to the appDataFolder space, which requires the %s scope", drive.DriveAppdataScope)
+	if d.scopesOrigin != "" {
+		msg += " (" + d.scopesOrigin + ")"
+	}
+	msg += "; obtain credentials with that scope, or set the fallbackToRoot option to store files in the root of the Drive instead"
+	return false, errors.E(errors.Permission, &wrapError{msg: msg, err: err})
+}
+
+// wrapError is an error which adds context to another, which remains
+// available to DriveError.
+type wrapError struct {
+	msg string
+	err error
+}
+
+func (e *wrapError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *wrapError) Unwrap() error {
+	return e.err
+}
+
+// sortNewestFirst sorts the files by decreasing creation time. Files created
+// at the same time are sorted by ID, so that the order is deterministic.
+func sortNewestFirst(files []*drive.File) {
+	created := make(map[*drive.File]time.Time, len(files))
+	for _, f := range files {
+		// Zero times for unparseable values sort the file last.
+		created[f], _ = time.Parse(time.RFC3339, f.CreatedTime)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ti, tj := created[files[i]], created[files[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return files[i].Id < files[j].Id
+	})
+}
+
+// queryEscaper escapes the characters which have a special meaning inside
+// the string literals of a Drive query.
+var queryEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// nameQuery returns a Drive query matching files with the given name.
+func nameQuery(name string) string {
+	return fmt.Sprintf("name='%s'", queryEscaper.Replace(name))
+}
@@ -25,6 +25,7 @@ var (
 )
 
 func TestPutAndDownload(t *testing.T) {
+	skipUnlessE2E(t)
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatalf("Can't put: %v", err)
@@ -39,6 +40,7 @@ func TestPutAndDownload(t *testing.T) {
 }
 
 func TestDeleteAndDownload(t *testing.T) {
+	skipUnlessE2E(t)
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatal(err)
@@ -61,12 +63,12 @@ func TestMain(m *testing.M) {
 	if !*runE2E || *accessToken == "" || *refreshToken == "" {
 		log.Printf(`
 
-cloud/storage/drive: skipping test as it requires Drive access. To enable this
+cloud/storage/drive: skipping e2e tests as they require Drive access. To enable this
 test, set the -run-e2e flag along with valid -access-token and -refresh-token
 flag values.
 
 `)
-		os.Exit(0)
+		os.Exit(m.Run())
 	}
 	// Set up Drive client.
 	var err error
@@ -82,27 +84,15 @@ flag values.
 	code := m.Run()
 
 	// Clean up.
-	if err := client.(*driveImpl).cleanup(); err != nil {
+	if _, err := client.(*driveImpl).DeleteByPrefix("test-file-"); err != nil {
 		log.Printf("cloud/storage/drive: clean-up failed: %v", err)
 	}
 	os.Exit(code)
 }
 
-// cleanup removes all files that are prefixed with 'test-file-' from the Drive and
-// returns the last error, if any.
-func (d *driveImpl) cleanup() error {
-	q := "name contains 'test-file-'"
-	call := d.files.List().Spaces("appDataFolder").Q(q).Fields("files(id, name)")
-	r, err := call.Do()
-	if err != nil {
-		return err
-	}
-	var er error
-	for _, f := range r.Files {
-		if err := d.files.Delete(f.Id).Do(); err != nil {
-			er = err
-		}
-		d.cache.Remove(f.Name)
+// skipUnlessE2E skips the calling test when no Drive client was set up.
+func skipUnlessE2E(t *testing.T) {
+	if client == nil {
+		t.Skip("requires Drive access")
 	}
-	return er
 }
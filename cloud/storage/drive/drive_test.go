@@ -0,0 +1,1335 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+func TestNameQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"foo", `name='foo'`},
+		{"foo'bar", `name='foo\'bar'`},
+		{`foo\bar`, `name='foo\\bar'`},
+		{`'\'`, `name='\'\\\''`},
+	} {
+		if got := nameQuery(tt.name); got != tt.want {
+			t.Errorf("nameQuery(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParents(t *testing.T) {
+	for _, tt := range []struct {
+		d    *driveImpl
+		want []string
+	}{
+		{&driveImpl{space: "appDataFolder"}, []string{"appDataFolder"}},
+		{&driveImpl{space: "drive"}, nil},
+		{&driveImpl{space: "drive", parent: "folder-id"}, []string{"folder-id"}},
+		{&driveImpl{space: "drive", driveId: "drive-id"}, []string{"drive-id"}},
+		{&driveImpl{space: "drive", driveId: "drive-id", parent: "folder-id"}, []string{"folder-id"}},
+	} {
+		if got := tt.d.parents(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parents() in space %q with parent %q = %q, want %q", tt.d.space, tt.d.parent, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteError(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	f.fail = func(method string, r *http.Request) int {
+		if method == "delete" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	err := d.Delete("ref")
+	e, ok := err.(*errors.Error)
+	if !ok {
+		t.Fatalf("got error %v, want *errors.Error", err)
+	}
+	if want := "cloud/storage/drive.Delete"; string(e.Op) != want {
+		t.Errorf("got op %q, want %q", e.Op, want)
+	}
+	if e.Kind != errors.IO {
+		t.Errorf("got kind %v, want %v", e.Kind, errors.IO)
+	}
+}
+
+func TestLinkForRef(t *testing.T) {
+	d, _ := newTestDrive(t)
+	d.space = "drive"
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	link, err := d.LinkForRef("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := d.fileId(context.Background(), "ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://drive.google.com/uc?id=" + id + "&export=download"; link != want {
+		t.Errorf("got link %q, want %q", link, want)
+	}
+	if _, err := d.LinkForRef("missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v, want NotExist", err)
+	}
+}
+
+func TestExists(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	for _, tt := range []struct {
+		ref  string
+		want bool
+	}{
+		{"ref", true},
+		{"missing", false},
+	} {
+		got, err := d.Exists(tt.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Exists(%q) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+	f.fail = func(string, *http.Request) int { return http.StatusInternalServerError }
+	if _, err := d.Exists("other"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	d, _ := newTestDrive(t)
+	data := []byte("some data")
+	before := time.Now().Add(-time.Second)
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.Stat("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("got size %d, want %d", info.Size, len(data))
+	}
+	if want := fmt.Sprintf("%x", md5.Sum(data)); info.MD5 != want {
+		t.Errorf("got MD5 %q, want %q", info.MD5, want)
+	}
+	if info.ModTime.Before(before) || info.ModTime.After(time.Now().Add(time.Second)) {
+		t.Errorf("got modification time %v, want around %v", info.ModTime, time.Now())
+	}
+	if _, err := d.Stat("missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v, want NotExist", err)
+	}
+}
+
+func TestFieldsSelected(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.verify = true
+	var (
+		mu      sync.Mutex
+		missing = make(map[string]bool)
+	)
+	f.fail = func(method string, r *http.Request) int {
+		// Downloads and deletions return no metadata.
+		if method != "download" && method != "delete" && r.URL.Query().Get("fields") == "" {
+			mu.Lock()
+			missing[method] = true
+			mu.Unlock()
+		}
+		return 0
+	}
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("ref", []byte("new data")); err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Remove("ref")
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename("ref", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	for method := range missing {
+		t.Errorf("%s request does not select its fields", method)
+	}
+}
+
+func TestTruncatedDownload(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.retryAttempts = 2
+	f.add("ref", []byte("some data"))
+	f.truncate = true
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+	if n := f.count("download"); n != 2 {
+		t.Errorf("got %d downloads, want 2", n)
+	}
+	if _, err := d.DownloadRange("ref", 0, 4); !errors.Is(errors.IO, err) {
+		t.Errorf("DownloadRange: got error %v, want IO", err)
+	}
+	f.mu.Lock()
+	f.truncate = false
+	f.mu.Unlock()
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "some data" {
+		t.Errorf("got %q, want %q", got, "some data")
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.verify = true
+	data := []byte("some data")
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	id := f.named("ref")[0]
+	f.mu.Lock()
+	f.files[id].data = []byte("some dat")
+	f.mu.Unlock()
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	f.fail = func(method string, r *http.Request) int {
+		if method == "list" {
+			// Give the other downloads time to pile up.
+			time.Sleep(50 * time.Millisecond)
+		}
+		return 0
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.Download("ref"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := f.count("list"); got != 1 {
+		t.Errorf("got %d List calls, want 1", got)
+	}
+	if got := f.count("download"); got != n {
+		t.Errorf("got %d downloads, want %d", got, n)
+	}
+}
+
+func TestCanceledLookup(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	listing := make(chan bool)
+	release := make(chan bool)
+	f.fail = func(method string, r *http.Request) int {
+		if method == "list" {
+			listing <- true
+			<-release
+		}
+		return 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := d.DownloadContext(ctx, "ref")
+		canceled <- err
+	}()
+	<-listing
+	done := make(chan error)
+	go func() {
+		_, err := d.Download("ref")
+		done <- err
+	}()
+	// Give the second download time to join the lookup.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-canceled; err == nil {
+		t.Errorf("canceled download succeeded")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("download sharing the lookup of a canceled one: %v", err)
+	}
+	if got := f.count("list"); got != 1 {
+		t.Errorf("got %d List calls, want 1", got)
+	}
+}
+
+func TestPutReplaces(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("ref", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 1 {
+		t.Fatalf("got %d files named ref, want 1", len(ids))
+	}
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestPutFailureKeepsOldContents(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	f.fail = func(method string, r *http.Request) int {
+		if method == "create" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	if err := d.Put("ref", []byte("new")); !errors.Is(errors.IO, err) {
+		t.Fatalf("got error %v, want IO", err)
+	}
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old" {
+		t.Errorf("got %q, want %q", got, "old")
+	}
+}
+
+func TestPutAndReturnID(t *testing.T) {
+	d, f := newTestDrive(t)
+	id, err := d.PutAndReturnID("ref", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 1 || ids[0] != id {
+		t.Errorf("got ID %q, want the ID of the only file named ref in %q", id, ids)
+	}
+}
+
+func TestSharedDrive(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.space = "drive"
+	d.driveId = "shared"
+	f.fail = func(method string, r *http.Request) int {
+		q := r.URL.Query()
+		if q.Get("supportsAllDrives") != "true" {
+			t.Errorf("%s request without supportsAllDrives: %v", method, r.URL)
+		}
+		if method == "list" && (q.Get("corpora") != "drive" || q.Get("driveId") != "shared") {
+			t.Errorf("list request not limited to the shared drive: %v", r.URL)
+		}
+		return 0
+	}
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Remove("ref")
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllDrives(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.space = "drive"
+	d.allDrives = true
+	f.fail = func(method string, r *http.Request) int {
+		q := r.URL.Query()
+		if q.Get("supportsAllDrives") != "true" {
+			t.Errorf("%s request without supportsAllDrives: %v", method, r.URL)
+		}
+		if method == "list" && (q.Get("corpora") != "allDrives" || q.Get("includeItemsFromAllDrives") != "true") {
+			t.Errorf("list request not spanning all drives: %v", r.URL)
+		}
+		return 0
+	}
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Remove("ref")
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.List(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []map[string]string{
+		{"includeAllDrives": "true"},
+		{"includeAllDrives": "true", "space": "appDataFolder"},
+		{"includeAllDrives": "true", "driveId": "shared"},
+		{"includeAllDrives": "maybe", "space": "drive"},
+	} {
+		opts["accessToken"] = "access"
+		opts["tokenType"] = "Bearer"
+		opts["refreshToken"] = "refresh"
+		opts["expiry"] = time.Now().Add(time.Hour).Format(time.RFC3339)
+		if _, err := New(&storage.Opts{Opts: opts}); !errors.Is(errors.Invalid, err) {
+			t.Errorf("New(%v): got error %v, want Invalid", opts, err)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.cacheTTL = time.Minute
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	files := &countingFiles{filesService: d.files}
+	d.files = files
+	f.add("ref", []byte("data"))
+	if _, err := d.fileId(context.Background(), "ref"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fileId(context.Background(), "ref"); err != nil {
+		t.Fatal(err)
+	}
+	if got := files.count("List"); got != 1 {
+		t.Errorf("got %d List calls, want 1", got)
+	}
+	now = now.Add(time.Minute)
+	if _, err := d.fileId(context.Background(), "ref"); err != nil {
+		t.Fatal(err)
+	}
+	if got := files.count("List"); got != 2 {
+		t.Errorf("got %d List calls after expiry, want 2", got)
+	}
+}
+
+func TestDownloadStaleId(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	// Replace the file behind the cache's back, as another client would.
+	for _, id := range f.named("ref") {
+		f.mu.Lock()
+		delete(f.files, id)
+		f.mu.Unlock()
+	}
+	f.add("ref", []byte("new"))
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+	if n := f.count("list"); n != 2 {
+		t.Errorf("got %d list requests, want 2", n)
+	}
+}
+
+func TestDownloadEvictsOnNotFound(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	f.fail = func(method string, r *http.Request) int {
+		if method == "download" {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Fatalf("got error %v, want IO", err)
+	}
+	if _, ok := d.cachedId("ref"); !ok {
+		t.Errorf("transient failure evicted the cache entry")
+	}
+	f.fail = func(method string, r *http.Request) int {
+		if method == "download" {
+			return http.StatusNotFound
+		}
+		return 0
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("got error %v, want NotExist", err)
+	}
+	if _, ok := d.cachedId("ref"); ok {
+		t.Errorf("not-found failure left the cache entry in place")
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.cache = newLRUCache(0)
+	files := &countingFiles{filesService: d.files}
+	d.files = files
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Download("ref"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := files.count("List"); got != 3 {
+		t.Errorf("got %d List calls, want 3", got)
+	}
+	// Another client replaces the file.
+	for _, id := range f.named("ref") {
+		f.mu.Lock()
+		delete(f.files, id)
+		f.mu.Unlock()
+	}
+	f.add("ref", []byte("new"))
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+}
+
+func TestCache(t *testing.T) {
+	d, f := newTestDrive(t)
+	files := &countingFiles{filesService: d.files}
+	d.files = files
+	f.add("ref", []byte("data"))
+	for i := 0; i < 3; i++ {
+		if _, err := d.Download("ref"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := files.count("List"); got != 1 {
+		t.Errorf("got %d List calls, want 1", got)
+	}
+	if got := files.count("Get"); got != 3 {
+		t.Errorf("got %d Get calls, want 3", got)
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Fatalf("got error %v, want NotExist", err)
+	}
+	if got := files.count("List"); got != 2 {
+		t.Errorf("got %d List calls after Delete, want 2", got)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.notFoundTTL = time.Minute
+	for i := 0; i < 3; i++ {
+		if ok, err := d.Exists("ref"); err != nil || ok {
+			t.Fatalf("Exists = %v, %v; want false, nil", ok, err)
+		}
+	}
+	if got := f.count("list"); got != 1 {
+		t.Errorf("got %d List calls, want 1", got)
+	}
+	if e, ok := d.cache.Get("ref"); !ok || !e.NotFound {
+		t.Errorf("got cache entry %+v (cached %v), want one marked NotFound", e, ok)
+	}
+	if _, ok := d.cachedId("ref"); ok {
+		t.Errorf("cachedId returned an ID for a name not found")
+	}
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Exists("ref"); err != nil || !ok {
+		t.Fatalf("Exists after Put = %v, %v; want true, nil", ok, err)
+	}
+
+	// Entries expire.
+	d.notFoundTTL = time.Millisecond
+	if ok, _ := d.Exists("other"); ok {
+		t.Fatal("other exists")
+	}
+	f.add("other", []byte("data"))
+	time.Sleep(10 * time.Millisecond)
+	if ok, err := d.Exists("other"); err != nil || !ok {
+		t.Fatalf("Exists after expiry = %v, %v; want true, nil", ok, err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("default", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithType("typed", []byte("data"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	d.contentType = "application/x-upspin"
+	if err := d.Put("configured", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]string{
+		"default":    ContentType,
+		"typed":      "text/plain",
+		"configured": "application/x-upspin",
+	} {
+		if got := f.file(f.named(ref)[0]).MimeType; got != want {
+			t.Errorf("got type %q for %s, want %q", got, ref, want)
+		}
+	}
+}
+
+func TestOnlyTagged(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.space = "drive"
+	d.onlyTagged = true
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	ids := f.named("ref")
+	if len(ids) != 1 || f.file(ids[0]).AppProperties[tagKey] != tagValue {
+		t.Fatalf("stored file is not tagged")
+	}
+	d.cache.Remove("ref")
+	if ok, err := d.Exists("ref"); err != nil || !ok {
+		t.Errorf("Exists(ref) = %v, %v; want true, nil", ok, err)
+	}
+
+	// A file placed by someone else is neither read nor deleted.
+	f.mu.Lock()
+	f.addLocked(&fakeFile{File: drive.File{Name: "foreign"}, data: []byte("data")})
+	f.mu.Unlock()
+	if ok, err := d.Exists("foreign"); err != nil || ok {
+		t.Errorf("Exists(foreign) = %v, %v; want false, nil", ok, err)
+	}
+	if err := d.Delete("foreign"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.named("foreign")) != 1 {
+		t.Errorf("foreign file was deleted")
+	}
+}
+
+func TestDuplicatesNewestWins(t *testing.T) {
+	d, f := newTestDrive(t)
+	now := time.Now()
+	f.addCreated("ref", []byte("middle"), now.Add(-time.Hour))
+	f.addCreated("ref", []byte("newest"), now)
+	f.addCreated("ref", []byte("oldest"), now.Add(-2*time.Hour))
+	for i := 0; i < 3; i++ {
+		d.cache.Remove("ref")
+		got, err := d.Download("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "newest" {
+			t.Fatalf("got %q, want %q", got, "newest")
+		}
+	}
+}
+
+func TestSortNewestFirst(t *testing.T) {
+	files := []*drive.File{
+		{Id: "b", CreatedTime: "2017-10-12T09:45:38.000Z"},
+		{Id: "c", CreatedTime: "garbage"},
+		{Id: "a", CreatedTime: "2017-10-12T09:45:38.000Z"},
+		{Id: "d", CreatedTime: "2017-10-13T09:45:38.000Z"},
+	}
+	sortNewestFirst(files)
+	var got string
+	for _, f := range files {
+		got += f.Id
+	}
+	if want := "dabc"; got != want {
+		t.Errorf("got order %q, want %q", got, want)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.softDelete = true
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	ids := f.named("ref")
+	if len(ids) != 1 || !f.file(ids[0]).Trashed {
+		t.Fatalf("file was not moved to the trash")
+	}
+	if f.count("delete") != 0 {
+		t.Errorf("file was permanently deleted")
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v, want NotExist", err)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		d, f := newTestDrive(t)
+		f.ignoreRange = ignoreRange
+		f.add("ref", []byte("0123456789"))
+		for _, tt := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, 10, "0123456789"},
+			{2, 3, "234"},
+			{7, 10, "789"},
+			{5, 0, ""},
+			{2, math.MaxInt64, "23456789"},
+		} {
+			got, err := d.DownloadRange("ref", tt.offset, tt.length)
+			if err != nil {
+				t.Errorf("DownloadRange(%d, %d) with ignoreRange=%v: %v", tt.offset, tt.length, ignoreRange, err)
+				continue
+			}
+			if string(got) != tt.want {
+				t.Errorf("DownloadRange(%d, %d) with ignoreRange=%v = %q, want %q", tt.offset, tt.length, ignoreRange, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDownloadRangeLimit(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.maxDownloadSize = 8
+	f.ignoreRange = true
+	f.add("ref", []byte(strings.Repeat("0123456789", 10)))
+	// Drive sends the whole contents, of which only the start is read.
+	got, err := d.DownloadRange("ref", 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "234" {
+		t.Errorf("got %q, want %q", got, "234")
+	}
+	if _, err := d.DownloadRange("ref", 20, 3); err == nil {
+		t.Errorf("got no error reading past the maximum download size")
+	}
+}
+
+func TestDownloadRangeErrors(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		d, f := newTestDrive(t)
+		f.ignoreRange = ignoreRange
+		f.add("ref", []byte("data"))
+		for _, tt := range []struct {
+			ref            string
+			offset, length int64
+			kind           errors.Kind
+		}{
+			{"ref", -1, 1, errors.Invalid},
+			{"ref", 0, -1, errors.Invalid},
+			{"ref", 4, 1, errors.Invalid},
+			{"missing", 0, 1, errors.NotExist},
+		} {
+			_, err := d.DownloadRange(tt.ref, tt.offset, tt.length)
+			if !errors.Is(tt.kind, err) {
+				t.Errorf("DownloadRange(%q, %d, %d) with ignoreRange=%v: got error %v, want %v", tt.ref, tt.offset, tt.length, ignoreRange, err, tt.kind)
+			}
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.compress = true
+	data := []byte(strings.Repeat("highly compressible text ", 100))
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	ids := f.named("ref")
+	if len(ids) != 1 {
+		t.Fatalf("got %d files, want 1", len(ids))
+	}
+	stored := f.file(ids[0])
+	if stored.AppProperties[compressKey] != compressValue {
+		t.Errorf("stored file is not marked as compressed: %v", stored.AppProperties)
+	}
+	if stored.Size >= int64(len(data)) {
+		t.Errorf("stored %d bytes for %d bytes of contents", stored.Size, len(data))
+	}
+	for _, cached := range []bool{true, false} {
+		if !cached {
+			d.cache.Remove("ref")
+		}
+		got, err := d.Download("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(data) {
+			t.Errorf("Download with cached=%v returned different contents", cached)
+		}
+	}
+	got, err := d.DownloadRange("ref", 25, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "highly " {
+		t.Errorf("DownloadRange = %q, want %q", got, "highly ")
+	}
+}
+
+func TestCompressReadsUncompressed(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.compress = true
+	f.add("ref", []byte("plain"))
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "plain" {
+		t.Errorf("got %q, want %q", got, "plain")
+	}
+}
+
+func TestDeleteStrict(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	if err := d.DeleteStrict("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 0 {
+		t.Errorf("ref was not deleted")
+	}
+	if err := d.DeleteStrict("ref"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("DeleteStrict of missing ref: got error %v, want NotExist", err)
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Errorf("Delete of missing ref: got error %v, want nil", err)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	d, f := newTestDrive(t)
+	for i := 0; i < 5; i++ {
+		f.add(fmt.Sprintf("dup%d", i), []byte("data"))
+	}
+	d.pageSize = 2
+	files, err := d.listAll(context.Background(), "", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("got %d files, want 5", len(files))
+	}
+	if n := f.count("list"); n != 3 {
+		t.Errorf("got %d list requests, want 3", n)
+	}
+}
+
+func TestPermissionErrors(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	f.fail = func(method string, r *http.Request) int {
+		return http.StatusUnauthorized
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.Permission, err) {
+		t.Errorf("Download: got error %v, want Permission", err)
+	}
+	if err := d.Put("ref", []byte("new")); !errors.Is(errors.Permission, err) {
+		t.Errorf("Put: got error %v, want Permission", err)
+	}
+	if err := d.Delete("ref"); !errors.Is(errors.Permission, err) {
+		t.Errorf("Delete: got error %v, want Permission", err)
+	}
+}
+
+func TestMaxDownloadSize(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.maxDownloadSize = 4
+	f.add("small", []byte("data"))
+	f.add("large", []byte("too much data"))
+	if _, err := d.Download("small"); err != nil {
+		t.Errorf("Download(small): %v", err)
+	}
+	if _, err := d.Download("large"); !errors.Is(errors.IO, err) {
+		t.Errorf("Download(large): got error %v, want IO", err)
+	}
+	// The limit applies to the decompressed contents.
+	d.compress = true
+	if err := d.Put("compressed", []byte(strings.Repeat("a", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Download("compressed"); !errors.Is(errors.IO, err) {
+		t.Errorf("Download(compressed): got error %v, want IO", err)
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	d, f := newTestDrive(t)
+	created, err := d.PutIfAbsent("ref", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Errorf("PutIfAbsent of a new ref returned false")
+	}
+	if n := f.count("list"); n != 1 {
+		t.Errorf("got %d list requests, want 1", n)
+	}
+	d.cache.Remove("ref")
+	created, err = d.PutIfAbsent("ref", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Errorf("PutIfAbsent of an existing ref returned true")
+	}
+	if n := f.count("create"); n != 1 {
+		t.Errorf("got %d create requests, want 1", n)
+	}
+	if n := f.count("delete"); n != 0 {
+		t.Errorf("got %d delete requests, want none", n)
+	}
+}
+
+func TestNotFoundRetries(t *testing.T) {
+	for _, tt := range []struct {
+		retries, lists int
+	}{
+		{0, 1},
+		{3, 2},
+	} {
+		d, f := newTestDrive(t)
+		d.notFoundRetries = tt.retries
+		f.fail = func(method string, r *http.Request) int {
+			// The file only shows up in the second listing.
+			if method == "list" && f.count("list") == 2 {
+				f.add("ref", []byte("data"))
+			}
+			return 0
+		}
+		_, err := d.Download("ref")
+		switch {
+		case tt.retries == 0 && !errors.Is(errors.NotExist, err):
+			t.Errorf("without retries: got error %v, want NotExist", err)
+		case tt.retries > 0 && err != nil:
+			t.Errorf("with %d retries: %v", tt.retries, err)
+		}
+		if n := f.count("list"); n != tt.lists {
+			t.Errorf("with %d retries: got %d list requests, want %d", tt.retries, n, tt.lists)
+		}
+	}
+}
+
+func TestNoAppData(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.noAppData = true
+	err := d.Put("ref", []byte("data"))
+	if !errors.Is(errors.Permission, err) {
+		t.Fatalf("got error %v, want Permission", err)
+	}
+	if !strings.Contains(err.Error(), "fallbackToRoot") {
+		t.Errorf("error %q doesn't explain how to fix it", err)
+	}
+
+	// Some credentials lacking the scope don't see the appDataFolder.
+	f.appDataNotFound = true
+	d.scopesOrigin = "the scopes option requested " + drive.DriveFileScope
+	_, err = d.List("")
+	if !errors.Is(errors.Permission, err) {
+		t.Fatalf("got error %v, want Permission", err)
+	}
+	for _, s := range []string{drive.DriveAppdataScope, d.scopesOrigin} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q doesn't mention %q", err, s)
+		}
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.Permission, err) {
+		t.Errorf("got error %v downloading, want Permission", err)
+	}
+
+	d.fallbackToRoot = true
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	ids := f.named("ref")
+	if len(ids) != 1 || len(f.file(ids[0]).Parents) != 0 {
+		t.Fatalf("file was not stored in the root folder")
+	}
+	d.cache.Remove("ref")
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data" {
+		t.Errorf("got %q, want %q", got, "data")
+	}
+}
+
+func TestDownloadWithInfo(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	for _, want := range []bool{false, true} {
+		got, info, err := d.DownloadWithInfo("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "data" {
+			t.Errorf("got %q, want %q", got, "data")
+		}
+		if info.CacheHit != want {
+			t.Errorf("got CacheHit %v, want %v", info.CacheHit, want)
+		}
+		// A lookup is only needed without a cache hit.
+		calls := 2
+		if want {
+			calls = 1
+		}
+		if info.Calls != calls || info.Bytes != 4 || info.Duration <= 0 {
+			t.Errorf("got %d calls, %d bytes in %v, want %d calls and 4 bytes", info.Calls, info.Bytes, info.Duration, calls)
+		}
+	}
+}
+
+func TestGoogleNativeFiles(t *testing.T) {
+	d, f := newTestDrive(t)
+	// Drive has no checksum for Google-native files, so verifying them
+	// must not fail.
+	d.verify = true
+	for ref, typ := range map[string]string{"doc": "document", "form": "form"} {
+		id := f.add(ref, []byte("exported "+ref))
+		f.mu.Lock()
+		f.files[id].MimeType = googleAppsPrefix + typ
+		f.files[id].Md5Checksum = ""
+		f.mu.Unlock()
+	}
+	got, err := d.Download("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "exported doc" {
+		t.Errorf("got %q, want %q", got, "exported doc")
+	}
+	if n := f.count("export"); n != 1 {
+		t.Errorf("got %d exports, want 1", n)
+	}
+	_, err = d.Download("form")
+	if !errors.Is(errors.Invalid, err) {
+		t.Errorf("got error %v for a file which can't be exported, want Invalid", err)
+	}
+}
+
+func TestInvalidRefs(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("valid", []byte("data"))
+	for _, ref := range []string{"", strings.Repeat("x", maxRefLength+1)} {
+		if err := d.Put(ref, []byte("data")); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Put of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.Download(ref); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Download of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if err := d.Delete(ref); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Delete of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.Exists(ref); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Exists of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.Stat(ref); !errors.Is(errors.Invalid, err) {
+			t.Errorf("Stat of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.LinkForRef(ref); !errors.Is(errors.Invalid, err) {
+			t.Errorf("LinkForRef of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.DownloadRange(ref, 0, 1); !errors.Is(errors.Invalid, err) {
+			t.Errorf("DownloadRange of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		if _, err := d.PutIfAbsent(ref, []byte("data")); !errors.Is(errors.Invalid, err) {
+			t.Errorf("PutIfAbsent of a %d-byte ref returned %v, want Invalid", len(ref), err)
+		}
+		for _, refs := range [][2]string{{"valid", ref}, {ref, "valid"}} {
+			if err := d.Copy(refs[0], refs[1]); !errors.Is(errors.Invalid, err) {
+				t.Errorf("Copy from %d-byte ref to %d-byte ref returned %v, want Invalid", len(refs[0]), len(refs[1]), err)
+			}
+			if err := d.Rename(refs[0], refs[1]); !errors.Is(errors.Invalid, err) {
+				t.Errorf("Rename from %d-byte ref to %d-byte ref returned %v, want Invalid", len(refs[0]), len(refs[1]), err)
+			}
+		}
+	}
+	for _, method := range []string{"create", "copy", "update"} {
+		if n := f.count(method); n != 0 {
+			t.Errorf("got %d %s calls, want none", n, method)
+		}
+	}
+	if err := d.Put(strings.Repeat("x", maxRefLength), []byte("data")); err != nil {
+		t.Errorf("Put of a %d-byte ref: %v", maxRefLength, err)
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	d, _ := newTestDrive(t)
+	d.chunkSize = googleapi.MinUploadChunkSize
+	data := bytes.Repeat([]byte("x"), 2*googleapi.MinUploadChunkSize+100)
+	var sent []int64
+	d.progress = func(name string, n, total int64) {
+		if name != "ref" || total != int64(len(data)) {
+			t.Errorf("got progress of %q out of %d, want %q out of %d", name, total, "ref", len(data))
+		}
+		sent = append(sent, n)
+	}
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) < 2 || sent[len(sent)-1] != int64(len(data)) {
+		t.Errorf("got progress %v, want several updates ending at %d", sent, len(data))
+	}
+	d.cache.Remove("ref")
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want the %d bytes uploaded", len(got), len(data))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	d.readOnly = true
+	calls := f.count("create") + f.count("update") + f.count("delete") + f.count("copy")
+	for name, fn := range map[string]func() error{
+		"Put":    func() error { return d.Put("ref", []byte("new")) },
+		"Delete": func() error { return d.Delete("ref") },
+		"Copy":   func() error { return d.Copy("ref", "copy") },
+		"Rename": func() error { return d.Rename("ref", "renamed") },
+		"Reconcile": func() error {
+			_, err := d.Reconcile()
+			return err
+		},
+	} {
+		if err := fn(); !errors.Is(errors.Permission, err) {
+			t.Errorf("%s returned %v, want Permission", name, err)
+		}
+	}
+	if n := f.count("create") + f.count("update") + f.count("delete") + f.count("copy") - calls; n != 0 {
+		t.Errorf("got %d calls modifying files, want none", n)
+	}
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data" {
+		t.Errorf("got %q, want %q", got, "data")
+	}
+	if list, err := d.List(""); err != nil || len(list) != 1 {
+		t.Errorf("List returned %v (error %v), want ref", list, err)
+	}
+}
+
+func TestResolveID(t *testing.T) {
+	d, f := newTestDrive(t)
+	want := f.add("ref", []byte("data"))
+	got, err := d.ResolveID("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got ID %q, want %q", got, want)
+	}
+	if _, err := d.ResolveID("missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v for a missing ref, want NotExist", err)
+	}
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.updateInPlace = true
+	d.compress = true
+	if err := d.Put("ref", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	id := f.named("ref")[0]
+	d.compress = false
+	if err := d.Put("ref", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 1 || ids[0] != id {
+		t.Fatalf("got files %v after replacing the contents, want %s only", ids, id)
+	}
+	if n := f.count("create"); n != 1 {
+		t.Errorf("got %d files created, want 1", n)
+	}
+	if _, ok := f.file(id).AppProperties[compressKey]; ok {
+		t.Errorf("file still marked compressed")
+	}
+	for _, cached := range []bool{true, false} {
+		if !cached {
+			d.cache.Remove("ref")
+		}
+		got, err := d.Download("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "second" {
+			t.Errorf("got %q with cached=%v, want %q", got, cached, "second")
+		}
+	}
+
+	// A file deleted since its ID was cached is stored anew.
+	f.mu.Lock()
+	delete(f.files, id)
+	f.mu.Unlock()
+	if err := d.Put("ref", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Remove("ref")
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "third" {
+		t.Errorf("got %q, want %q", got, "third")
+	}
+}
+
+func TestNameCheck(t *testing.T) {
+	d, f := newTestDrive(t)
+	for _, ref := range []string{"a", "b"} {
+		if err := d.Put(ref, []byte(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another client renames the file holding a.
+	id := f.named("a")[0]
+	f.mu.Lock()
+	f.files[id].Name = "renamed"
+	f.mu.Unlock()
+	if _, err := d.Download("a"); err != nil {
+		t.Fatalf("Download without name checks: %v", err)
+	}
+	d.nameCheckRate = 1
+	if _, err := d.Download("a"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download of a renamed file returned %v, want NotExist", err)
+	}
+	if _, ok := d.cache.Get("a"); ok {
+		t.Errorf("renamed file is still cached")
+	}
+	got, err := d.Download("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "b" {
+		t.Errorf("got %q, want %q", got, "b")
+	}
+	if _, ok := d.cachedId("b"); !ok {
+		t.Errorf("file whose name was checked is no longer cached")
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.fileId(context.Background(), "ref"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("list"); n != 1 {
+		t.Fatalf("got %d lists before flushing the cache, want 1", n)
+	}
+	d.FlushCache()
+	if _, ok := d.cache.Get("ref"); ok {
+		t.Errorf("ref is still cached")
+	}
+	if _, err := d.fileId(context.Background(), "ref"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("list"); n != 2 {
+		t.Errorf("got %d lists after flushing the cache, want 2", n)
+	}
+}
+
+func TestSeedCache(t *testing.T) {
+	d, f := newTestDrive(t)
+	for _, ref := range []string{"a", "b"} {
+		if err := d.Put(ref, []byte(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.compress = true
+	if err := d.Put("z", []byte(strings.Repeat("highly compressible text ", 100))); err != nil {
+		t.Fatal(err)
+	}
+	dump := d.DumpCache()
+	want := map[string]string{"a": f.named("a")[0], "b": f.named("b")[0]}
+	if !reflect.DeepEqual(dump, want) {
+		t.Fatalf("got dump %v, want %v", dump, want)
+	}
+
+	// After a restart, the seeded refs are downloaded without lookups.
+	d.cache = newLRUCache(LRUSize)
+	d.SeedCache(dump)
+	lists := f.count("list")
+	for _, ref := range []string{"a", "b"} {
+		if got, err := d.Download(ref); err != nil || string(got) != ref {
+			t.Errorf("Download(%q) = %q, %v; want %q", ref, got, err, ref)
+		}
+	}
+	if n := f.count("list") - lists; n != 0 {
+		t.Errorf("got %d lists for seeded refs, want 0", n)
+	}
+	if got := d.DumpCache(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got dump %v after seeding, want %v", got, want)
+	}
+
+	// Cached entries are kept, and stale seeds are looked up again.
+	d.SeedCache(map[string]string{"a": "bogus", "c": "bogus"})
+	if id, _ := d.cachedId("a"); id != want["a"] {
+		t.Errorf("got cached ID %q for a, want %q", id, want["a"])
+	}
+	f.add("c", []byte("c"))
+	if got, err := d.Download("c"); err != nil || string(got) != "c" {
+		t.Errorf("Download(%q) = %q, %v; want %q", "c", got, err, "c")
+	}
+}
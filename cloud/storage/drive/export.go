@@ -0,0 +1,63 @@
+package drive
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"upspin.io/errors"
+)
+
+// googleAppsPrefix prefixes the MIME types of Google-native files, such as
+// Google Docs, which have no contents of their own and can only be exported.
+const googleAppsPrefix = "application/vnd.google-apps."
+
+// exportFormats maps the MIME types of the Google-native files which can be
+// exported to the format in which they are downloaded.
+var exportFormats = map[string]string{
+	googleAppsPrefix + "document":     "application/pdf",
+	googleAppsPrefix + "spreadsheet":  "text/csv",
+	googleAppsPrefix + "presentation": "application/pdf",
+	googleAppsPrefix + "drawing":      "image/png",
+	googleAppsPrefix + "script":       "application/vnd.google-apps.script+json",
+}
+
+// isNotDownloadable reports whether err is a Drive error reporting that the
+// file has no contents to download, as is the case of Google-native files.
+func isNotDownloadable(err error) bool {
+	e, ok := googleErr(err)
+	if !ok || e.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "fileNotDownloadable" {
+			return true
+		}
+	}
+	return false
+}
+
+// export returns the contents of the Google-native file with the given ID,
+// exported in the format given by exportFormats. Files of other types can't
+// be read and cause an errors.Invalid error.
+func (d *driveImpl) export(ctx context.Context, id string) ([]byte, error) {
+	f, err := d.getFile(ctx, id, "mimeType")
+	if err != nil {
+		return nil, err
+	}
+	format, ok := exportFormats[f.MimeType]
+	if !ok {
+		kind := strings.TrimPrefix(f.MimeType, googleAppsPrefix)
+		return nil, errors.E(errors.Invalid, errors.Errorf("file %s is a Google-native %s, which can't be downloaded or exported", id, kind))
+	}
+	var slurp []byte
+	err = d.retry(ctx, "files.export", func(ctx context.Context) error {
+		resp, err := d.files.Export(id, format).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		slurp, err = d.readBody(resp)
+		return err
+	})
+	return slurp, err
+}
@@ -0,0 +1,815 @@
+package drive
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// fakeDrive is an in-memory implementation of the subset of the Drive v3
+// REST API used by driveImpl.
+type fakeDrive struct {
+	mu     sync.Mutex
+	files  map[string]*fakeFile // by ID
+	lastID int
+	// calls counts the requests served, by method: "list", "get",
+	// "download", "export", "create", "upload", "delete", "update",
+	// "copy", "permission" and "about".
+	calls map[string]int
+	// quota is the storage limit reported by the about endpoint.
+	quota int64
+	// fail, if set, is called before serving each request with the
+	// method being served. A non-zero return value is sent back to
+	// the client as the status code of an error response.
+	fail func(method string, r *http.Request) int
+	// failReason, if set, is the reason reported for the failures
+	// injected by fail, instead of the default one for their code.
+	failReason string
+	// noAppData makes requests for the appDataFolder space fail, as they
+	// do when the credentials lack the drive.appdata scope.
+	noAppData bool
+	// appDataNotFound makes lists fail as noAppData does for some
+	// credentials, by reporting the appDataFolder as not found.
+	appDataNotFound bool
+	// ignoreRange makes downloads send the whole contents even when a
+	// Range header is present.
+	ignoreRange bool
+	// truncate makes downloads send only the first half of the contents,
+	// although their full length is announced.
+	truncate bool
+	// sessions holds the files being uploaded through resumable uploads,
+	// by upload ID.
+	sessions   map[string]*fakeFile
+	lastUpload int
+}
+
+// fakeFile is a file stored by fakeDrive.
+type fakeFile struct {
+	drive.File
+	data []byte
+	// perms holds the permissions created on the file.
+	perms []drive.Permission
+}
+
+// newTestDrive returns a driveImpl which talks to a new fakeDrive. The
+// server is shut down when the test completes.
+func newTestDrive(t *testing.T) (*driveImpl, *fakeDrive) {
+	f := &fakeDrive{
+		files: make(map[string]*fakeFile),
+		calls: make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	svc, err := drive.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.BasePath = srv.URL + "/drive/v3/"
+	return &driveImpl{
+		files:          svc.Files,
+		about:          svc.About,
+		permissions:    svc.Permissions,
+		cache:          newLRUCache(LRUSize),
+		retryAttempts:  1,
+		retryBaseDelay: RetryBaseDelay,
+		retryMaxDelay:  RetryMaxDelay,
+		chunkSize:      UploadChunkSize,
+		space:          "appDataFolder",
+		metrics:        nopMetrics{},
+		concurrency:    BatchConcurrency,
+		contentType:    ContentType,
+		now:            time.Now,
+	}, f
+}
+
+// add stores a file with the given name and contents directly, bypassing
+// the API, and returns its ID.
+func (f *fakeDrive) add(name string, data []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addLocked(&fakeFile{
+		File: drive.File{Name: name, Parents: []string{"appDataFolder"}},
+		data: data,
+	})
+}
+
+func (f *fakeDrive) addLocked(file *fakeFile) string {
+	f.lastID++
+	file.Id = fmt.Sprintf("id%d", f.lastID)
+	file.Size = int64(len(file.data))
+	file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(file.data))
+	file.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+	if file.CreatedTime == "" {
+		file.CreatedTime = file.ModifiedTime
+	}
+	if !f.inSpace(file, "appDataFolder") {
+		file.WebContentLink = "https://drive.google.com/uc?id=" + file.Id + "&export=download"
+	}
+	f.files[file.Id] = file
+	return file.Id
+}
+
+// named returns the IDs of the files with the given name, in creation order.
+func (f *fakeDrive) named(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id, file := range f.files {
+		if file.Name == name {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return idNum(ids[i]) < idNum(ids[j]) })
+	return ids
+}
+
+// addCreated is like add but also sets the creation time of the file.
+func (f *fakeDrive) addCreated(name string, data []byte, created time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addLocked(&fakeFile{
+		File: drive.File{
+			Name:        name,
+			Parents:     []string{"appDataFolder"},
+			CreatedTime: created.UTC().Format(time.RFC3339Nano),
+		},
+		data: data,
+	})
+}
+
+// file returns the metadata of the file with the given ID.
+func (f *fakeDrive) file(id string) drive.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.files[id].File
+}
+
+// count returns the number of requests served for the given method.
+func (f *fakeDrive) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func idNum(id string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(id, "id"))
+	return n
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/drive/v3/about" {
+		f.about(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/upload")
+	path = strings.TrimPrefix(path, "/drive/v3/files")
+	id := strings.TrimPrefix(path, "/")
+	var method string
+	switch {
+	case r.Method == "GET" && id == "":
+		method = "list"
+	case r.Method == "GET" && strings.HasSuffix(id, "/export"):
+		method = "export"
+		id = strings.TrimSuffix(id, "/export")
+	case r.Method == "GET" && r.URL.Query().Get("alt") == "media":
+		method = "download"
+	case r.Method == "GET":
+		method = "get"
+	case r.Method == "POST" && id == "":
+		method = "create"
+	case r.Method == "PUT" && id == "" && r.URL.Query().Get("upload_id") != "":
+		method = "upload"
+	case r.Method == "POST" && strings.HasSuffix(id, "/copy"):
+		method = "copy"
+		id = strings.TrimSuffix(id, "/copy")
+	case r.Method == "POST" && strings.HasSuffix(id, "/permissions"):
+		method = "permission"
+		id = strings.TrimSuffix(id, "/permissions")
+	case r.Method == "DELETE":
+		method = "delete"
+	case r.Method == "PATCH":
+		method = "update"
+	default:
+		f.error(w, http.StatusNotImplemented, "unsupported request %s %s", r.Method, r.URL)
+		return
+	}
+	f.mu.Lock()
+	f.calls[method]++
+	fail, reason := f.fail, f.failReason
+	f.mu.Unlock()
+	if fail != nil {
+		if code := fail(method, r); code != 0 {
+			f.injectedError(w, code, reason)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch method {
+	case "list":
+		f.list(w, r)
+	case "create":
+		f.create(w, r)
+	case "upload":
+		f.upload(w, r)
+	default:
+		file, ok := f.files[id]
+		if !ok {
+			f.error(w, http.StatusNotFound, "File not found: %s.", id)
+			return
+		}
+		switch method {
+		case "get":
+			writeJSON(w, &file.File)
+		case "download":
+			f.download(w, r, file)
+		case "export":
+			if !strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+				f.errorReason(w, http.StatusForbidden, "fileNotExportable", "Export only supports Docs Editors files.")
+				return
+			}
+			w.Header().Set("Content-Type", r.URL.Query().Get("mimeType"))
+			w.Write(file.data)
+		case "delete":
+			delete(f.files, id)
+			w.WriteHeader(http.StatusNoContent)
+		case "update":
+			f.update(w, r, file)
+		case "copy":
+			f.copy(w, r, file)
+		case "permission":
+			var perm drive.Permission
+			if err := json.NewDecoder(r.Body).Decode(&perm); err != nil {
+				f.error(w, http.StatusBadRequest, "bad body: %v", err)
+				return
+			}
+			perm.Id = fmt.Sprintf("perm%d", len(file.perms))
+			file.perms = append(file.perms, perm)
+			writeJSON(w, &perm)
+		}
+	}
+}
+
+// download serves the contents of file, honoring a Range header of the
+// form "bytes=first-last".
+func (f *fakeDrive) download(w http.ResponseWriter, r *http.Request, file *fakeFile) {
+	if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+		f.errorReason(w, http.StatusForbidden, "fileNotDownloadable", "Only files with binary content can be downloaded. Use Export with Docs Editors files.")
+		return
+	}
+	if f.truncate {
+		w.Header().Set("Content-Length", strconv.Itoa(len(file.data)))
+		w.Write(file.data[:len(file.data)/2])
+		return
+	}
+	rng := r.Header.Get("Range")
+	if rng == "" || f.ignoreRange {
+		w.Write(file.data)
+		return
+	}
+	var first, last int
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last {
+		f.error(w, http.StatusBadRequest, "bad range %q", rng)
+		return
+	}
+	if first >= len(file.data) {
+		f.error(w, http.StatusRequestedRangeNotSatisfiable, "range %q not satisfiable", rng)
+		return
+	}
+	if last >= len(file.data) {
+		last = len(file.data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(file.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(file.data[first : last+1])
+}
+
+func (f *fakeDrive) about(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls["about"]++
+	fail, reason := f.fail, f.failReason
+	f.mu.Unlock()
+	if fail != nil {
+		if code := fail("about", r); code != 0 {
+			f.injectedError(w, code, reason)
+			return
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var usage int64
+	for _, file := range f.files {
+		usage += file.Size
+	}
+	writeJSON(w, &drive.About{
+		StorageQuota: &drive.AboutStorageQuota{Limit: f.quota, Usage: usage},
+		User:         &drive.User{EmailAddress: "user@example.com"},
+	})
+}
+
+func (f *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if f.noAppData && strings.Contains(q.Get("spaces"), "appDataFolder") {
+		if f.appDataNotFound {
+			f.errorReason(w, http.StatusNotFound, "notFound", "File not found: appDataFolder.")
+			return
+		}
+		f.errorReason(w, http.StatusForbidden, "insufficientScopes", "The granted scopes do not give access to all of the requested spaces.")
+		return
+	}
+	var matches []*fakeFile
+	for _, file := range f.files {
+		ok, err := matchQuery(file, q.Get("q"))
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "Invalid Value: %v", err)
+			return
+		}
+		if ok && f.inSpace(file, q.Get("spaces")) {
+			matches = append(matches, file)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return idNum(matches[i].Id) < idNum(matches[j].Id) })
+	start, _ := strconv.Atoi(q.Get("pageToken"))
+	size, _ := strconv.Atoi(q.Get("pageSize"))
+	if size <= 0 {
+		size = 100
+	}
+	var list drive.FileList
+	for i := start; i < len(matches) && i < start+size; i++ {
+		file := matches[i].File
+		list.Files = append(list.Files, &file)
+	}
+	if start+size < len(matches) {
+		list.NextPageToken = strconv.Itoa(start + size)
+	}
+	writeJSON(w, &list)
+}
+
+func (f *fakeDrive) create(w http.ResponseWriter, r *http.Request) {
+	file := new(fakeFile)
+	typ, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.URL.Query().Get("uploadType") == "resumable":
+		// The contents follow in the requests of an upload session.
+		if err := json.NewDecoder(r.Body).Decode(&file.File); err != nil {
+			f.error(w, http.StatusBadRequest, "bad body: %v", err)
+			return
+		}
+		file.MimeType = r.Header.Get("X-Upload-Content-Type")
+		if f.sessions == nil {
+			f.sessions = make(map[string]*fakeFile)
+		}
+		f.lastUpload++
+		uploadID := strconv.Itoa(f.lastUpload)
+		f.sessions[uploadID] = file
+		w.Header().Set("Location", "http://"+r.Host+"/upload/drive/v3/files?uploadType=resumable&upload_id="+uploadID)
+		return
+	case err == nil && typ == "application/json":
+		// A file without contents, such as a folder.
+		if err := json.NewDecoder(r.Body).Decode(&file.File); err != nil {
+			f.error(w, http.StatusBadRequest, "bad body: %v", err)
+			return
+		}
+	case err == nil && typ == "multipart/related":
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for i := 0; i < 2; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				f.error(w, http.StatusBadRequest, "reading part %d: %v", i, err)
+				return
+			}
+			if i == 0 {
+				err = json.NewDecoder(p).Decode(&file.File)
+			} else {
+				file.MimeType = p.Header.Get("Content-Type")
+				file.data, err = ioutil.ReadAll(p)
+			}
+			if err != nil {
+				f.error(w, http.StatusBadRequest, "reading part %d: %v", i, err)
+				return
+			}
+		}
+	default:
+		f.error(w, http.StatusBadRequest, "unsupported upload of type %q", typ)
+		return
+	}
+	if f.noAppData && f.inSpace(file, "appDataFolder") {
+		f.errorReason(w, http.StatusForbidden, "insufficientScopes", "The granted scopes do not allow use of the Application Data folder.")
+		return
+	}
+	f.addLocked(file)
+	writeJSON(w, &file.File)
+}
+
+// upload serves a chunk of the contents of a resumable upload, described
+// by a Content-Range header of the form "bytes first-last/total", where the
+// total is "*" until the last chunk, or "bytes */total" for an empty last
+// chunk.
+func (f *fakeDrive) upload(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("upload_id")
+	file, ok := f.sessions[uploadID]
+	if !ok {
+		f.error(w, http.StatusNotFound, "no upload session %q", uploadID)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "reading chunk: %v", err)
+		return
+	}
+	rng := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	i := strings.LastIndex(rng, "/")
+	if i < 0 {
+		f.error(w, http.StatusBadRequest, "bad Content-Range %q", rng)
+		return
+	}
+	file.data = append(file.data, data...)
+	if rng[i+1:] == "*" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(file.data)-1))
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	if total, err := strconv.Atoi(rng[i+1:]); err != nil || total != len(file.data) {
+		f.error(w, http.StatusBadRequest, "got %d bytes, want %s", len(file.data), rng[i+1:])
+		return
+	}
+	delete(f.sessions, uploadID)
+	if f.noAppData && f.inSpace(file, "appDataFolder") {
+		f.errorReason(w, http.StatusForbidden, "insufficientScopes", "The granted scopes do not allow use of the Application Data folder.")
+		return
+	}
+	f.addLocked(file)
+	writeJSON(w, &file.File)
+}
+
+// update applies the metadata changes in the body of the request to the
+// file, and replaces its contents if they are sent too. Only the fields
+// supported by driveImpl are handled. As with Drive, appProperties are
+// merged into the existing ones, and those set to null are removed.
+func (f *fakeDrive) update(w http.ResponseWriter, r *http.Request, file *fakeFile) {
+	var (
+		changes map[string]json.RawMessage
+		data    []byte
+	)
+	typ, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case err == nil && typ == "application/json":
+		err = json.NewDecoder(r.Body).Decode(&changes)
+	case err == nil && typ == "multipart/related":
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var p *multipart.Part
+		if p, err = mr.NextPart(); err == nil {
+			err = json.NewDecoder(p).Decode(&changes)
+		}
+		if err == nil {
+			p, err = mr.NextPart()
+		}
+		if err == nil {
+			data, err = ioutil.ReadAll(p)
+		}
+	default:
+		err = fmt.Errorf("unsupported update of type %q", typ)
+	}
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if data != nil {
+		file.data = data
+		file.Size = int64(len(data))
+		file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(data))
+		file.ModifiedTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	for k, v := range changes {
+		var err error
+		switch k {
+		case "name":
+			err = json.Unmarshal(v, &file.Name)
+		case "trashed":
+			err = json.Unmarshal(v, &file.Trashed)
+			file.TrashedTime = ""
+			if file.Trashed {
+				file.TrashedTime = time.Now().UTC().Format(time.RFC3339Nano)
+			}
+		case "appProperties":
+			var props map[string]*string
+			err = json.Unmarshal(v, &props)
+			if file.AppProperties == nil {
+				file.AppProperties = make(map[string]string)
+			}
+			for pk, pv := range props {
+				if pv == nil {
+					delete(file.AppProperties, pk)
+				} else {
+					file.AppProperties[pk] = *pv
+				}
+			}
+		default:
+			err = fmt.Errorf("unsupported field %q", k)
+		}
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "bad field %q: %v", k, err)
+			return
+		}
+	}
+	q := r.URL.Query()
+	if rm := q.Get("removeParents"); rm != "" {
+		var parents []string
+		for _, p := range file.Parents {
+			if !strings.Contains(","+rm+",", ","+p+",") {
+				parents = append(parents, p)
+			}
+		}
+		file.Parents = parents
+	}
+	if add := q.Get("addParents"); add != "" {
+		file.Parents = append(file.Parents, strings.Split(add, ",")...)
+	}
+	writeJSON(w, &file.File)
+}
+
+// copy stores a copy of the file, to which the metadata in the body of the
+// request is applied.
+func (f *fakeDrive) copy(w http.ResponseWriter, r *http.Request, file *fakeFile) {
+	var patch drive.File
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		f.error(w, http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	c := &fakeFile{File: file.File, data: append([]byte(nil), file.data...)}
+	c.CreatedTime = ""
+	c.AppProperties = make(map[string]string)
+	for k, v := range file.AppProperties {
+		c.AppProperties[k] = v
+	}
+	for k, v := range patch.AppProperties {
+		c.AppProperties[k] = v
+	}
+	if patch.Name != "" {
+		c.Name = patch.Name
+	}
+	if patch.Parents != nil {
+		c.Parents = patch.Parents
+	}
+	f.addLocked(c)
+	writeJSON(w, &c.File)
+}
+
+// error replies to the request with a Drive API error response.
+func (f *fakeDrive) error(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	f.errorReason(w, code, reasons[code], format, args...)
+}
+
+// injectedError replies to the request with an injected failure, with the
+// given reason if set.
+func (f *fakeDrive) injectedError(w http.ResponseWriter, code int, reason string) {
+	if reason == "" {
+		reason = reasons[code]
+	}
+	f.errorReason(w, code, reason, "injected failure")
+}
+
+// errorReason is like error but reports the given reason.
+func (f *fakeDrive) errorReason(w http.ResponseWriter, code int, reason, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": msg,
+			"errors": []map[string]string{
+				{"reason": reason, "message": msg},
+			},
+		},
+	})
+}
+
+// reasons holds the reason reported by the fake for each error status code.
+var reasons = map[int]string{
+	http.StatusBadRequest:          "badRequest",
+	http.StatusUnauthorized:        "authError",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "notFound",
+	http.StatusTooManyRequests:     "rateLimitExceeded",
+	http.StatusInternalServerError: "backendError",
+	http.StatusNotImplemented:      "notImplemented",
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// inSpace reports whether the file lives in the given comma-separated list
+// of spaces. Files in folders live in the space of their folder.
+func (f *fakeDrive) inSpace(file *fakeFile, spaces string) bool {
+	appData := f.inAppData(file)
+	for _, s := range strings.Split(spaces, ",") {
+		if s == "appDataFolder" && appData || s == "drive" && !appData {
+			return true
+		}
+	}
+	return spaces == "" && !appData
+}
+
+// inAppData reports whether the file lives in the appDataFolder space.
+func (f *fakeDrive) inAppData(file *fakeFile) bool {
+	for _, p := range file.Parents {
+		if p == "appDataFolder" {
+			return true
+		}
+		if parent, ok := f.files[p]; ok && f.inAppData(parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchQuery reports whether the file matches the Drive query q. Only the
+// clauses generated by driveImpl are supported.
+func matchQuery(file *fakeFile, q string) (bool, error) {
+	for _, clause := range splitQuery(q) {
+		ok, err := matchClause(file, clause)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// splitQuery splits q into the clauses which are joined by a top-level
+// "and" operator.
+func splitQuery(q string) []string {
+	var (
+		clauses []string
+		quoted  bool
+		depth   int
+		start   int
+	)
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case depth == 0 && strings.HasPrefix(q[i:], " and "):
+			clauses = append(clauses, q[start:i])
+			i += len(" and ") - 1
+			start = i + 1
+		}
+	}
+	if q != "" {
+		clauses = append(clauses, q[start:])
+	}
+	return clauses
+}
+
+func matchClause(file *fakeFile, clause string) (bool, error) {
+	clause = strings.TrimSpace(clause)
+	switch {
+	case clause == "trashed = false":
+		return !file.Trashed, nil
+	case clause == "trashed = true":
+		return file.Trashed, nil
+	case strings.HasPrefix(clause, "name="):
+		s, err := unquote(strings.TrimPrefix(clause, "name="))
+		return file.Name == s, err
+	case strings.HasPrefix(clause, "name contains "):
+		s, err := unquote(strings.TrimPrefix(clause, "name contains "))
+		return strings.Contains(file.Name, s), err
+	case strings.HasPrefix(clause, "appProperties has { ") && strings.HasSuffix(clause, " }"):
+		kv := strings.TrimSuffix(strings.TrimPrefix(clause, "appProperties has { "), " }")
+		parts := strings.Split(kv, " and ")
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "key=") || !strings.HasPrefix(parts[1], "value=") {
+			return false, fmt.Errorf("bad appProperties clause %q", clause)
+		}
+		k, err := unquote(strings.TrimPrefix(parts[0], "key="))
+		if err != nil {
+			return false, err
+		}
+		v, err := unquote(strings.TrimPrefix(parts[1], "value="))
+		if err != nil {
+			return false, err
+		}
+		got, ok := file.AppProperties[k]
+		return ok && got == v, nil
+	case strings.HasPrefix(clause, "mimeType = "):
+		s, err := unquote(strings.TrimPrefix(clause, "mimeType = "))
+		return file.MimeType == s, err
+	case strings.HasPrefix(clause, "mimeType != "):
+		s, err := unquote(strings.TrimPrefix(clause, "mimeType != "))
+		return file.MimeType != s, err
+	case strings.HasPrefix(clause, "(") && strings.HasSuffix(clause, ")"):
+		// Only disjunctions of simple clauses are supported.
+		for _, c := range strings.Split(clause[1:len(clause)-1], " or ") {
+			ok, err := matchClause(file, c)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case strings.HasSuffix(clause, " in parents"):
+		s, err := unquote(strings.TrimSuffix(clause, " in parents"))
+		for _, p := range file.Parents {
+			if p == s {
+				return true, err
+			}
+		}
+		return false, err
+	}
+	return false, fmt.Errorf("unsupported query clause %q", clause)
+}
+
+// unquote returns the value of the Drive query string literal s.
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return "", fmt.Errorf("bad string literal %s", s)
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// countingFiles is a filesService which counts the calls built by driveImpl.
+type countingFiles struct {
+	filesService
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *countingFiles) inc(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[method]++
+}
+
+func (c *countingFiles) count(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[method]
+}
+
+func (c *countingFiles) List() *drive.FilesListCall {
+	c.inc("List")
+	return c.filesService.List()
+}
+
+func (c *countingFiles) Get(id string) *drive.FilesGetCall {
+	c.inc("Get")
+	return c.filesService.Get(id)
+}
+
+func (c *countingFiles) Create(file *drive.File) *drive.FilesCreateCall {
+	c.inc("Create")
+	return c.filesService.Create(file)
+}
+
+func (c *countingFiles) Delete(id string) *drive.FilesDeleteCall {
+	c.inc("Delete")
+	return c.filesService.Delete(id)
+}
+
+func (c *countingFiles) Update(id string, file *drive.File) *drive.FilesUpdateCall {
+	c.inc("Update")
+	return c.filesService.Update(id, file)
+}
+
+func (c *countingFiles) Copy(id string, file *drive.File) *drive.FilesCopyCall {
+	c.inc("Copy")
+	return c.filesService.Copy(id, file)
+}
+
+func (c *countingFiles) Export(id, mimeType string) *drive.FilesExportCall {
+	c.inc("Export")
+	return c.filesService.Export(id, mimeType)
+}
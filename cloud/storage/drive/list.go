@@ -0,0 +1,86 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// ListEntry describes a file returned by List.
+type ListEntry struct {
+	// Ref is the ref stored in the file, which is its name.
+	Ref string
+	// ID is the Drive ID of the file.
+	ID string
+	// Size is the size of the stored contents in bytes.
+	Size int64
+	// ModTime is the time at which the contents were last modified.
+	ModTime time.Time
+}
+
+// List returns the files holding the refs which start with the given
+// prefix, sorted by ref. An empty prefix lists all the files. A ref stored
+// in several files, as may be left behind by interrupted Puts, is listed
+// once for each.
+func (d *driveImpl) List(prefix string) ([]ListEntry, error) {
+	const op = "cloud/storage/drive.List"
+	if err := d.checkOpen(op); err != nil {
+		return nil, err
+	}
+	var q string
+	if prefix != "" {
+		q = fmt.Sprintf("name contains '%s'", queryEscaper.Replace(prefix))
+	}
+	files, err := d.listAll(withTarget(context.Background(), op, ""), q, "id, name, size, modifiedTime, appProperties")
+	if err != nil {
+		return nil, errors.E(op, errKind(err), err)
+	}
+	entries := make([]ListEntry, 0, len(files))
+	for _, f := range files {
+		// Drive's contains operator also matches the prefixes of the
+		// words within a name.
+		if !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		if f.AppProperties[partOfKey] != "" {
+			// The parts of split contents are listed through their
+			// first part.
+			continue
+		}
+		mod, err := time.Parse(time.RFC3339, f.ModifiedTime)
+		if err != nil {
+			return nil, errors.E(op, errors.IO, errors.Errorf("couldn't parse modifiedTime of %q: %v", f.Name, err))
+		}
+		entries = append(entries, ListEntry{Ref: f.Name, ID: f.Id, Size: f.Size, ModTime: mod})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Ref != entries[j].Ref {
+			return entries[i].Ref < entries[j].Ref
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// listOpts sets the size of the pages of listings of d from the options.
+// Sizes beyond what Drive supports are reduced to MaxPageSize, and negative
+// ones leave the default to Drive.
+func (d *driveImpl) listOpts(o *storage.Opts) error {
+	pageSize, err := intOpt(o, "pageSize", 0)
+	if err != nil {
+		return err
+	}
+	switch {
+	case pageSize > MaxPageSize:
+		pageSize = MaxPageSize
+	case pageSize < 0:
+		pageSize = 0
+	}
+	d.pageSize = int64(pageSize)
+	return nil
+}
@@ -0,0 +1,38 @@
+package drive
+
+import "testing"
+
+func TestList(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("b/2", []byte("22"))
+	f.add("a/1", []byte("1"))
+	f.add("b/1", []byte("333"))
+	f.add("other b/3", []byte("4444"))
+	entries, err := d.List("b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Ref)
+		if e.ID == "" || e.ModTime.IsZero() {
+			t.Errorf("incomplete entry %+v", e)
+		}
+	}
+	if len(got) != 2 || got[0] != "b/1" || got[1] != "b/2" {
+		t.Fatalf("List(b/) = %q, want [b/1 b/2]", got)
+	}
+	if entries[0].Size != 3 || entries[1].Size != 2 {
+		t.Errorf("got sizes %d, %d; want 3, 2", entries[0].Size, entries[1].Size)
+	}
+	all, err := d.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Errorf("List() returned %d entries, want 4", len(all))
+	}
+	if n := f.count("get"); n != 0 {
+		t.Errorf("got %d get requests, want none", n)
+	}
+}
@@ -0,0 +1,89 @@
+package drive
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements of the calls made to the Drive API, which
+// count against the per-project quotas. Its methods may be called
+// concurrently.
+type Metrics interface {
+	// Call is called after each call to the Drive API method (such as
+	// "files.list") has completed, with its duration and resulting error.
+	Call(method string, d time.Duration, err error)
+	// RateLimited is called whenever a call to the method is rejected
+	// because a rate limit was exceeded.
+	RateLimited(method string)
+}
+
+// nopMetrics is the Metrics implementation used by default, which discards
+// all measurements.
+type nopMetrics struct{}
+
+func (nopMetrics) Call(string, time.Duration, error) {}
+func (nopMetrics) RateLimited(string)                {}
+
+// SetMetrics sets the Metrics to which the calls made to the Drive API are
+// reported. A nil Metrics discards all measurements. It must be called
+// before the storage is used.
+func (d *driveImpl) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	d.metrics = m
+	if d.replica != nil {
+		d.replica.SetMetrics(m)
+	}
+}
+
+// callCounts counts the calls made to each Drive API method.
+type callCounts struct {
+	m sync.Map // method name to *int64
+}
+
+func (c *callCounts) inc(method string) {
+	n, ok := c.m.Load(method)
+	if !ok {
+		n, _ = c.m.LoadOrStore(method, new(int64))
+	}
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+// opStats accumulates the work done by Drive on behalf of a single
+// operation. Its fields are accessed atomically.
+type opStats struct {
+	calls int64
+	bytes int64
+}
+
+// opStatsKey is the key of the context value holding the *opStats of the
+// operation on behalf of which Drive calls are made.
+type opStatsKey struct{}
+
+// withOpStats returns a copy of ctx accumulating the work done by the Drive
+// calls made with it in the returned opStats.
+func withOpStats(ctx context.Context) (context.Context, *opStats) {
+	s := new(opStats)
+	return context.WithValue(ctx, opStatsKey{}, s), s
+}
+
+// opStatsFrom returns the opStats held by ctx, if any.
+func opStatsFrom(ctx context.Context) (*opStats, bool) {
+	s, ok := ctx.Value(opStatsKey{}).(*opStats)
+	return s, ok
+}
+
+// Stats returns the number of calls made to each Drive API method, such as
+// "files.list", since the storage was created. Every attempt of a retried
+// call is counted.
+func (d *driveImpl) Stats() map[string]int64 {
+	stats := make(map[string]int64)
+	d.counts.m.Range(func(k, v interface{}) bool {
+		stats[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,89 @@
+package drive
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics is a Metrics which records the measurements it receives.
+type recordingMetrics struct {
+	mu          sync.Mutex
+	calls       map[string]int
+	failures    map[string]int
+	rateLimited map[string]int
+}
+
+func (m *recordingMetrics) Call(method string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[method]++
+	if err != nil {
+		m.failures[method]++
+	}
+}
+
+func (m *recordingMetrics) RateLimited(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rateLimited[method]++
+}
+
+func TestMetrics(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.retryAttempts = 2
+	m := &recordingMetrics{
+		calls:       make(map[string]int),
+		failures:    make(map[string]int),
+		rateLimited: make(map[string]int),
+	}
+	d.SetMetrics(m)
+	limited := false
+	f.fail = func(method string, r *http.Request) int {
+		if method == "download" && !limited {
+			limited = true
+			return http.StatusTooManyRequests
+		}
+		return 0
+	}
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Remove("ref")
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		counts map[string]int
+		method string
+		want   int
+	}{
+		{m.calls, "files.list", 2},
+		{m.calls, "files.create", 1},
+		{m.calls, "files.get", 2},
+		{m.failures, "files.get", 1},
+		{m.rateLimited, "files.get", 1},
+		{m.rateLimited, "files.list", 0},
+	} {
+		if got := tt.counts[tt.method]; got != tt.want {
+			t.Errorf("got %d for %s, want %d", got, tt.method, tt.want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	d, _ := newTestDrive(t)
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	// The ID cached by Put saves listing the file again.
+	want := map[string]int64{"files.list": 1, "files.create": 1, "files.get": 1}
+	if got := d.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package drive
+
+import (
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestNamespace(t *testing.T) {
+	d, f := newTestDrive(t)
+	// as makes d act as the storage of the given tenant, which shares the
+	// files but not the cache.
+	as := func(namespace string) {
+		d.namespace = namespace
+		d.cache = newLRUCache(LRUSize)
+	}
+	as("a")
+	if err := d.Put("ref", []byte("a's data")); err != nil {
+		t.Fatal(err)
+	}
+	as("b")
+	if _, err := d.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download of another tenant's ref returned %v, want NotExist", err)
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 1 {
+		t.Fatalf("got %d files named ref after another tenant deleted it, want 1", len(ids))
+	}
+	if list, err := d.List(""); err != nil || len(list) != 0 {
+		t.Errorf("List returned %v (error %v), want no refs", list, err)
+	}
+	if err := d.Put("ref", []byte("b's data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range []string{"a", "b"} {
+		as(tenant)
+		got, err := d.Download("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tenant + "'s data"; string(got) != want {
+			t.Errorf("tenant %s got %q, want %q", tenant, got, want)
+		}
+	}
+	// Without a namespace, all files are visible, as before.
+	as("")
+	if list, err := d.List(""); err != nil || len(list) != 2 {
+		t.Errorf("List returned %v (error %v), want both tenants' files", list, err)
+	}
+}
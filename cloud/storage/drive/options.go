@@ -0,0 +1,186 @@
+package drive
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// Option configures a Storage created by NewWithOptions.
+type Option func(*options)
+
+// options holds the configuration set by Options.
+type options struct {
+	// client, if set, is the client on top of which requests are
+	// authenticated.
+	client *http.Client
+	// cache, if set, replaces the in-memory cache of file IDs.
+	cache Cache
+	// onRetry, if set, is notified of retried calls.
+	onRetry RetryFunc
+	// progress, if set, is notified of the progress of uploads.
+	progress ProgressFunc
+	// now, if set, replaces time.Now.
+	now func() time.Time
+	// settings holds the values of storage options set by typed Options,
+	// which override those of storage.Opts.
+	settings map[string]string
+}
+
+// set sets the value of the storage option with the given key.
+func (o *options) set(key, value string) {
+	if o.settings == nil {
+		o.settings = make(map[string]string)
+	}
+	o.settings[key] = value
+}
+
+// WithHTTPClient makes the Storage send its requests, including those
+// refreshing OAuth2 tokens, through the given client. Authentication is
+// added on top of the client's transport, which may for instance go
+// through a proxy or trust custom TLS roots.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithTransport is like WithHTTPClient but takes the transport used to
+// make the requests.
+func WithTransport(rt http.RoundTripper) Option {
+	return WithHTTPClient(&http.Client{Transport: rt})
+}
+
+// WithCache makes the Storage cache the IDs of the files holding refs in c,
+// instead of in memory. The "cacheSize" option is then ignored.
+func WithCache(c Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// RetryFunc is called before waiting to retry a failed Drive call. The op
+// names the Storage operation which made the call, such as
+// "cloud/storage/drive.Download", "cloud/storage/drive.lookup" for the
+// lookups of file IDs shared by concurrent operations, or else the Drive API
+// method, and ref the ref it concerns, if any. The attempt is the number of attempts which
+// failed so far, and err the error of the last one. It may be called
+// concurrently and must not block.
+type RetryFunc func(op, ref string, attempt int, err error)
+
+// WithOnRetry makes the Storage call fn whenever a Drive call is retried,
+// which allows elevated retry rates to be noticed before they turn into
+// failures. A nil fn disables the notifications.
+func WithOnRetry(fn RetryFunc) Option {
+	return func(o *options) {
+		o.onRetry = fn
+	}
+}
+
+// ProgressFunc is called as the contents of a file are uploaded in chunks,
+// with the name of the file, which is the ref or, for contents split into
+// parts, that of a part, the number of bytes sent so far and the total
+// number of bytes to send, or -1 if it is not known in advance. A retried
+// upload starts over from zero. It must not block.
+type ProgressFunc func(name string, sent, total int64)
+
+// WithProgress makes the Storage call fn to report the progress of the
+// uploads made in several chunks, which are those larger than the
+// "uploadChunkSize" option. A nil fn disables the notifications.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithCacheSize sets the number of file IDs cached in memory, as does the
+// "cacheSize" option.
+func WithCacheSize(n int) Option {
+	return func(o *options) {
+		o.set("cacheSize", strconv.Itoa(n))
+	}
+}
+
+// WithSpace sets the Drive space in which files are stored, such as
+// "appDataFolder" or "drive", as does the "space" option.
+func WithSpace(space string) Option {
+	return func(o *options) {
+		o.set("space", space)
+	}
+}
+
+// WithRequestTimeout sets the time after which a single Drive call is
+// abandoned, as does the "requestTimeout" option.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.set("requestTimeout", d.String())
+	}
+}
+
+// WithClock makes the Storage read the current time from now instead of
+// time.Now, to age cache entries and honor Retry-After dates. It allows
+// tests to expire them without waiting. A nil now restores time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// intOpt returns the value of the integer option with the given key, or def
+// if the option is not set.
+func intOpt(o *storage.Opts, key string, def int) (int, error) {
+	v, ok := o.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.Errorf("couldn't parse %s %q: %v", key, v, err)
+	}
+	return n, nil
+}
+
+// durationOpt returns the value of the duration option with the given key,
+// or def if the option is not set.
+func durationOpt(o *storage.Opts, key string, def time.Duration) (time.Duration, error) {
+	v, ok := o.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	t, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Errorf("couldn't parse %s %q: %v", key, v, err)
+	}
+	return t, nil
+}
+
+// floatOpt returns the value of the floating-point option with the given
+// key, or def if the option is not set.
+func floatOpt(o *storage.Opts, key string, def float64) (float64, error) {
+	v, ok := o.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.Errorf("couldn't parse %s %q: %v", key, v, err)
+	}
+	return f, nil
+}
+
+// boolOpt returns the value of the boolean option with the given key, or
+// false if the option is not set.
+func boolOpt(o *storage.Opts, key string) (bool, error) {
+	v, ok := o.Opts[key]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Errorf("couldn't parse %s %q: %v", key, v, err)
+	}
+	return b, nil
+}
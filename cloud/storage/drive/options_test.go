@@ -0,0 +1,255 @@
+package drive
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// roundTripFunc is an http.RoundTripper implemented by a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestWithTransport(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []*http.Request
+	)
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		reqs = append(reqs, r)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"files": []}`)),
+			Request:    r,
+		}, nil
+	})
+	s, err := NewWithOptions(&storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+	}}, WithTransport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := s.(*driveImpl).Exists("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("Exists = true, want false")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests through the transport, want 1", len(reqs))
+	}
+	if got, want := reqs[0].Header.Get("Authorization"), "Bearer access"; got != want {
+		t.Errorf("got Authorization %q, want %q", got, want)
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewWithContext(ctx, &storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       time.Now().Add(-time.Hour).Format(time.RFC3339),
+		"tokenURL":     srv.URL,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.(*driveImpl).Exists("ref")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Exists succeeded without a token")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("token refresh did not fail after the context was cancelled")
+	}
+}
+
+func TestAppName(t *testing.T) {
+	agents := make(chan string, 1)
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		agents <- r.Header.Get("User-Agent")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"files": []}`)),
+			Request:    r,
+		}, nil
+	})
+	s, err := NewWithOptions(&storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+		"appName":      "my-deployment",
+	}}, WithTransport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.(*driveImpl).Exists("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-agents; !strings.Contains(got, "my-deployment") {
+		t.Errorf("got User-Agent %q, want it to hold the application name", got)
+	}
+}
+
+func TestNewWithToken(t *testing.T) {
+	auth := make(chan string, 1)
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		auth <- r.Header.Get("Authorization")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"files": []}`)),
+			Request:    r,
+		}, nil
+	})
+	tok := &oauth2.Token{
+		AccessToken:  "access",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	s, err := NewWithToken(tok, WithTransport(rt), WithSpace("drive"), WithRequestTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := s.(*driveImpl)
+	if d.space != "drive" || d.timeout != time.Minute {
+		t.Errorf("got space %q and timeout %v, want %q and %v", d.space, d.timeout, "drive", time.Minute)
+	}
+	if _, err := d.Exists("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-auth, "Bearer access"; got != want {
+		t.Errorf("got Authorization %q, want %q", got, want)
+	}
+
+	if _, err := NewWithToken(tok, WithCacheSize(-1)); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got error %v for a negative cache size, want Invalid", err)
+	}
+	if _, err := NewWithToken(nil); !errors.Is(errors.Invalid, err) {
+		t.Errorf("got error %v for a nil token, want Invalid", err)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`))
+	}))
+	defer srv.Close()
+	opts := map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "revoked",
+		"expiry":       time.Now().Add(-time.Hour).Format(time.RFC3339),
+		"tokenURL":     srv.URL,
+	}
+	if _, err := New(&storage.Opts{Opts: opts}); err != nil {
+		t.Fatalf("New checked the credentials without validateCredentials: %v", err)
+	}
+	opts["validateCredentials"] = "true"
+	_, err := New(&storage.Opts{Opts: opts})
+	if !errors.Is(errors.Permission, err) {
+		t.Errorf("got error %v for revoked credentials, want Permission", err)
+	}
+}
+
+func TestRetryDelays(t *testing.T) {
+	for _, tt := range []struct {
+		base, max string
+		valid     bool
+	}{
+		{"", "", true},
+		{"1s", "1m", true},
+		{"1s", "1s", true},
+		{"0s", "", false},
+		{"-1s", "", false},
+		{"1m", "1s", false},
+		{"", "2h", false},
+		{"garbage", "", false},
+	} {
+		opts := map[string]string{
+			"accessToken":  "access",
+			"tokenType":    "Bearer",
+			"refreshToken": "refresh",
+			"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+		}
+		if tt.base != "" {
+			opts["retryBaseDelay"] = tt.base
+		}
+		if tt.max != "" {
+			opts["retryMaxDelay"] = tt.max
+		}
+		_, err := New(&storage.Opts{Opts: opts})
+		if tt.valid && err != nil {
+			t.Errorf("base %q, max %q: %v", tt.base, tt.max, err)
+		}
+		if !tt.valid && !errors.Is(errors.Invalid, err) {
+			t.Errorf("base %q, max %q: got error %v, want Invalid", tt.base, tt.max, err)
+		}
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	opts := &storage.Opts{Opts: map[string]string{
+		"accessToken":  "access",
+		"tokenType":    "Bearer",
+		"refreshToken": "refresh",
+		"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+	}}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := NewWithOptions(opts, WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.(*driveImpl).now(); !got.Equal(now) {
+		t.Errorf("got time %v, want %v", got, now)
+	}
+	s, err = NewWithOptions(opts, WithClock(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.(*driveImpl).now == nil {
+		t.Errorf("got no clock with a nil one, want time.Now")
+	}
+}
@@ -0,0 +1,153 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// Contents larger than the "maxFileSize" option are split into parts of at
+// most that size, stored in separate files. The first part is stored under
+// the ref itself, so that refs are found as usual, and the others under
+// partName. The appProperties of the first part hold the number of parts,
+// under partsKey, and the version of the contents, under versionKey, with
+// which the other parts are tagged under partOfKey. Parts of contents which
+// were since replaced are thus never mixed with the current ones.
+const (
+	partsKey   = "parts"
+	versionKey = "partsVersion"
+	partOfKey  = "partOf"
+)
+
+// partName returns the name of the file holding the given part of ref.
+func partName(ref string, part int) string {
+	return fmt.Sprintf("%s.part%d", ref, part)
+}
+
+// uploadParts stores b, the contents of ref, split into parts, and returns
+// the file holding the first part. The other parts are stored first, so
+// that the first one, through which they are found, is only stored once
+// they are all in place. It records the parts in e.
+func (d *driveImpl) uploadParts(ctx context.Context, ref string, b []byte, contentType string, props map[string]string, e *CacheEntry) (*drive.File, error) {
+	version, err := newVersion()
+	if err != nil {
+		return nil, err
+	}
+	max := d.maxFileSize
+	n := (len(b) + max - 1) / max
+	for i := 1; i < n; i++ {
+		part := b[i*max:]
+		if len(part) > max {
+			part = part[:max]
+		}
+		partProps := d.newProps()
+		partProps[partOfKey] = version
+		if _, err := d.upload(ctx, partName(ref, i), bytes.NewReader(part), int64(len(part)), contentType, partProps); err != nil {
+			return nil, err
+		}
+	}
+	props[partsKey] = strconv.Itoa(n)
+	props[versionKey] = version
+	f, err := d.upload(ctx, ref, bytes.NewReader(b[:max]), int64(max), contentType, props)
+	if err != nil {
+		return nil, err
+	}
+	e.Parts, e.Version = n, version
+	return f, nil
+}
+
+// newVersion returns a random version tagging the parts of new contents.
+func newVersion() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// partFiles returns the given fields of the files holding the parts of the
+// contents described by e, other than the first one, in order. Missing
+// parts are nil.
+func (d *driveImpl) partFiles(ctx context.Context, ref string, e CacheEntry, fields string) ([]*drive.File, error) {
+	parts := make([]*drive.File, e.Parts-1)
+	for i := range parts {
+		files, err := d.listNamed(ctx, partName(ref, i+1), fields+", appProperties")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.AppProperties[partOfKey] == e.Version {
+				parts[i] = f
+				break
+			}
+		}
+	}
+	return parts, nil
+}
+
+// downloadParts appends the parts of the contents described by e, other
+// than the first one, to slurp, which holds the first one.
+func (d *driveImpl) downloadParts(ctx context.Context, ref string, e CacheEntry, slurp []byte) ([]byte, error) {
+	parts, err := d.partFiles(ctx, ref, e, "id")
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range parts {
+		if f == nil {
+			return nil, errors.Errorf("part %d of %d of %q is missing", i+1, e.Parts, ref)
+		}
+		b, err := d.download(ctx, f.Id)
+		if err != nil {
+			return nil, err
+		}
+		if d.verify {
+			if err := d.checkSum(ctx, partName(ref, i+1), f.Id, b); err != nil {
+				return nil, err
+			}
+		}
+		slurp = append(slurp, b...)
+		if d.maxDownloadSize > 0 && int64(len(slurp)) > d.maxDownloadSize {
+			return nil, tooLarge(d.maxDownloadSize)
+		}
+	}
+	return slurp, nil
+}
+
+// removeParts deletes the parts of the contents described by e, other than
+// the first one. Missing parts are ignored.
+func (d *driveImpl) removeParts(ctx context.Context, ref string, e CacheEntry) error {
+	parts, err := d.partFiles(ctx, ref, e, "id")
+	if err != nil {
+		return err
+	}
+	for _, f := range parts {
+		if f == nil {
+			continue
+		}
+		if err := d.remove(ctx, f.Id); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// partsOpts sets the size beyond which d splits contents into parts from
+// the options.
+func (d *driveImpl) partsOpts(o *storage.Opts) error {
+	maxFileSize, err := intOpt(o, "maxFileSize", 0)
+	if err != nil {
+		return err
+	}
+	if maxFileSize < 0 {
+		return errors.Errorf("maxFileSize can not be negative, got %d", maxFileSize)
+	}
+	d.maxFileSize = maxFileSize
+	return nil
+}
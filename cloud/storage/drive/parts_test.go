@@ -0,0 +1,93 @@
+package drive
+
+import (
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.maxFileSize = 4
+	data := []byte("0123456789")
+	if err := d.Put("ref", data); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ref", "ref.part1", "ref.part2"} {
+		if ids := f.named(name); len(ids) != 1 {
+			t.Errorf("got %d files named %q, want 1", len(ids), name)
+		}
+	}
+	for _, cached := range []bool{true, false} {
+		if !cached {
+			d.cache.Remove("ref")
+		}
+		got, err := d.Download("ref")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(data) {
+			t.Errorf("got %q with cached=%v, want %q", got, cached, data)
+		}
+	}
+	got, err := d.DownloadRange("ref", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "3456" {
+		t.Errorf("DownloadRange returned %q, want %q", got, "3456")
+	}
+	info, err := d.Stat("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("got size %d, want %d", info.Size, len(data))
+	}
+	list, err := d.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Ref != "ref" {
+		t.Errorf("List returned %v, want ref only", list)
+	}
+
+	// Replacing the contents removes the previous parts.
+	if err := d.Put("ref", []byte("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"ref": 1, "ref.part1": 1, "ref.part2": 0} {
+		if ids := f.named(name); len(ids) != want {
+			t.Errorf("got %d files named %q, want %d", len(ids), name, want)
+		}
+	}
+	d.cache.Remove("ref")
+	got, err = d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("got %q, want %q", got, "abcdef")
+	}
+
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ref", "ref.part1"} {
+		if ids := f.named(name); len(ids) != 0 {
+			t.Errorf("%q was not deleted", name)
+		}
+	}
+}
+
+func TestPartsSmallContents(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.maxFileSize = 4
+	if err := d.Put("ref", []byte("0123")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref.part1"); len(ids) != 0 {
+		t.Errorf("contents fitting in a file were split")
+	}
+	if got := f.file(f.named("ref")[0]).AppProperties[partsKey]; got != "" {
+		t.Errorf("got %s parts, want none", got)
+	}
+}
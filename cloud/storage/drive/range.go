@@ -0,0 +1,156 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+
+	"google.golang.org/api/googleapi"
+	"upspin.io/errors"
+)
+
+// DownloadRange returns length bytes of the contents of the given ref,
+// starting at offset. Fewer bytes are returned if the contents end before
+// offset+length.
+func (d *driveImpl) DownloadRange(ref string, offset, length int64) ([]byte, error) {
+	const op = "cloud/storage/drive.DownloadRange"
+	if err := d.checkOpen(op); err != nil {
+		return nil, err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid range: offset %d, length %d", offset, length))
+	}
+	if length > math.MaxInt64-offset {
+		// No contents reach that far, and offset+length must not overflow.
+		length = math.MaxInt64 - offset
+	}
+	ctx := withTarget(context.Background(), op, ref)
+	_, hit := d.cachedEntry(ref)
+	e, err := d.readEntry(ctx, ref)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, errors.E(op, errKind(err), err)
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if !rangeable(e) {
+		return d.sliceDownload(ctx, op, ref, offset, length)
+	}
+	slurp, err := d.downloadRange(ctx, e.ID, offset, length)
+	if hit {
+		switch {
+		case isNotFound(err):
+			d.stale.staleHit(ref, d.now())
+		case err == nil:
+			d.stale.freshHit(ref)
+		}
+	}
+	if isNotFound(err) {
+		// The cached ID is stale, as in Download. Look it up again, once.
+		d.cache.Remove(ref)
+		e, err = d.readEntry(ctx, ref)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, errors.E(op, errors.NotExist, err)
+			}
+			return nil, errors.E(op, errKind(err), err)
+		}
+		if !rangeable(e) {
+			return d.sliceDownload(ctx, op, ref, offset, length)
+		}
+		slurp, err = d.downloadRange(ctx, e.ID, offset, length)
+	}
+	if err != nil {
+		if e, ok := googleErr(err); ok && e.Code == http.StatusRequestedRangeNotSatisfiable {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("offset %d is beyond the end of the contents", offset))
+		}
+		if isNotFound(err) {
+			d.cache.Remove(ref)
+			return nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, errors.E(op, errKind(err), err)
+	}
+	return slurp, nil
+}
+
+// rangeable reports whether ranges of the contents described by e can be
+// downloaded directly. Offsets into compressed or encrypted contents are
+// meaningless, and split contents span several files.
+func rangeable(e CacheEntry) bool {
+	return !e.Compressed && !e.Encrypted && e.Parts <= 1
+}
+
+// sliceDownload implements DownloadRange on behalf of op for contents which
+// aren't rangeable, by downloading them whole.
+func (d *driveImpl) sliceDownload(ctx context.Context, op, ref string, offset, length int64) ([]byte, error) {
+	slurp, err := d.DownloadContext(ctx, ref)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if offset >= int64(len(slurp)) {
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("offset %d is beyond the end of the contents", offset))
+	}
+	return sliceRange(slurp, offset, length), nil
+}
+
+// downloadRange returns length bytes of the contents of the file with the
+// given ID, starting at offset, even if Drive sends them whole.
+func (d *driveImpl) downloadRange(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	var slurp []byte
+	err := d.retry(ctx, "files.get", func(ctx context.Context) error {
+		call := d.get(id)
+		call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		resp, err := call.Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// Only the start of the contents is needed if Drive ignores the
+		// range and sends them whole.
+		want := length
+		if resp.StatusCode != http.StatusPartialContent {
+			want = offset + length
+		}
+		slurp, err = readLimited(io.LimitReader(resp.Body, want), d.maxDownloadSize)
+		if err != nil {
+			return truncated(err)
+		}
+		if n := resp.ContentLength; n >= 0 {
+			if n > want {
+				n = want
+			}
+			if int64(len(slurp)) != n {
+				return &truncatedError{msg: fmt.Sprintf("got %d bytes, want %d", len(slurp), n)}
+			}
+		}
+		if resp.StatusCode == http.StatusPartialContent {
+			return nil
+		}
+		// The range was not honored and the whole contents were sent.
+		if offset >= int64(len(slurp)) {
+			return &googleapi.Error{Code: http.StatusRequestedRangeNotSatisfiable}
+		}
+		slurp = sliceRange(slurp, offset, length)
+		return nil
+	})
+	return slurp, err
+}
+
+// sliceRange returns the part of b which starts at offset and is at most
+// length bytes long. The offset must be within b.
+func sliceRange(b []byte, offset, length int64) []byte {
+	b = b[offset:]
+	if length < int64(len(b)) {
+		b = b[:length]
+	}
+	return b
+}
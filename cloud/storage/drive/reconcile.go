@@ -0,0 +1,79 @@
+package drive
+
+import (
+	"context"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// Reconcile removes the duplicate files left behind by interrupted Puts.
+// For every ref stored in more than one file it keeps the newest file, which
+// is the one read by Download, and deletes the others. It returns the number
+// of files deleted.
+//
+// It is safe to run alongside normal traffic: the files stored under each
+// ref are listed again right before deleting any of them.
+func (d *driveImpl) Reconcile() (int, error) {
+	const op = "cloud/storage/drive.Reconcile"
+	if err := d.checkOpen(op); err != nil {
+		return 0, err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	files, err := d.listAll(ctx, "", "id, name")
+	if err != nil {
+		return 0, errors.E(op, errKind(err), err)
+	}
+	count := make(map[string]int)
+	for _, f := range files {
+		count[f.Name]++
+	}
+	removed := 0
+	for name, n := range count {
+		if n < 2 {
+			continue
+		}
+		// Re-check, as the files may have changed since they were listed.
+		dups, err := d.listNamed(ctx, name, "id, createdTime")
+		if err != nil {
+			return removed, errors.E(op, errKind(err), err)
+		}
+		if len(dups) < 2 {
+			continue
+		}
+		sortNewestFirst(dups)
+		for _, f := range dups[1:] {
+			n, err := d.deleteFile(ctx, name, f.Id)
+			removed += n
+			if err != nil {
+				return removed, errors.E(op, errKind(err), err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// deleteFile deletes the file with the given ID, which is stored under the
+// given name, and returns the number of files deleted. A file which no longer
+// exists is not an error. In dry-run mode the file is only reported as
+// deleted.
+func (d *driveImpl) deleteFile(ctx context.Context, name, id string) (int, error) {
+	if d.dryRun {
+		log.Info.Printf("cloud/storage/drive: dry run: would delete %q (%s)", name, id)
+		return 1, nil
+	}
+	err := d.remove(ctx, id)
+	if isNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if cached, ok := d.cachedId(name); ok && cached == id {
+		d.cache.Remove(name)
+	}
+	return 1, nil
+}
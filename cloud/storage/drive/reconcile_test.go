@@ -0,0 +1,82 @@
+package drive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	d, f := newTestDrive(t)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		f.addCreated("dup", []byte("old"), now.Add(-time.Duration(i+1)*time.Hour))
+	}
+	newest := f.addCreated("dup", []byte("new"), now)
+	f.add("single", []byte("data"))
+	f.addCreated("pair", []byte("old"), now.Add(-time.Hour))
+	f.addCreated("pair", []byte("new"), now)
+
+	n, err := d.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("removed %d files, want 4", n)
+	}
+	if ids := f.named("dup"); len(ids) != 1 || ids[0] != newest {
+		t.Errorf("got files %q named dup, want only %q", ids, newest)
+	}
+	for _, ref := range []string{"single", "pair"} {
+		if ids := f.named(ref); len(ids) != 1 {
+			t.Errorf("got %d files named %s, want 1", len(ids), ref)
+		}
+		got, err := d.Download(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref == "pair" && string(got) != "new" {
+			t.Errorf("got %q for pair, want %q", got, "new")
+		}
+	}
+	if n, err := d.Reconcile(); n != 0 || err != nil {
+		t.Errorf("second Reconcile = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.dryRun = true
+	now := time.Now()
+	f.addCreated("dup", []byte("old"), now.Add(-time.Hour))
+	f.addCreated("dup", []byte("new"), now)
+	f.add("test-file-1", []byte("data"))
+	if err := d.Put("ref", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("ref", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("ref"); len(ids) != 1 {
+		t.Errorf("Put left %d files named ref, want 1", len(ids))
+	}
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteBatch([]string{"ref", "test-file-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.DeleteByPrefix("test-file-"); err != nil || n != 1 {
+		t.Errorf("DeleteByPrefix = %d, %v; want 1, nil", n, err)
+	}
+	if n, err := d.Reconcile(); err != nil || n != 1 {
+		t.Errorf("Reconcile = %d, %v; want 1, nil", n, err)
+	}
+	if n := f.count("delete"); n != 1 {
+		t.Errorf("got %d delete requests, want only the one made by Put", n)
+	}
+	for _, ref := range []string{"ref", "test-file-1"} {
+		if _, err := d.Download(ref); err != nil {
+			t.Errorf("Download(%q): %v", ref, err)
+		}
+	}
+}
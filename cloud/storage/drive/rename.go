@@ -0,0 +1,94 @@
+package drive
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+// Rename moves the contents stored under oldRef to newRef, by renaming the
+// file holding them. As with Put, any previous contents of newRef are
+// replaced.
+func (d *driveImpl) Rename(oldRef, newRef string) error {
+	const op = "cloud/storage/drive.Rename"
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return err
+	}
+	if err := checkRef(op, oldRef); err != nil {
+		return err
+	}
+	if err := checkRef(op, newRef); err != nil {
+		return err
+	}
+	ctx := withTarget(context.Background(), op, oldRef)
+	src, err := d.readEntry(ctx, oldRef)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.E(op, errors.NotExist, err)
+		}
+		return errors.E(op, errKind(err), err)
+	}
+	if src.Parts > 1 {
+		return errors.E(op, errors.Invalid, errors.Errorf("%q is stored in %d parts, which can't be renamed", oldRef, src.Parts))
+	}
+	if oldRef == newRef {
+		return nil
+	}
+	old, err := d.fileEntry(ctx, newRef)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.E(op, errKind(err), err)
+	}
+	var addParents, removeParents string
+	if d.shardLen > 0 {
+		// The file moves to the subfolder of newRef.
+		addParents, removeParents, err = d.moveShard(ctx, src.ID, newRef)
+		if err != nil && !isNotFound(err) {
+			return errors.E(op, errKind(err), err)
+		}
+	}
+	err = d.retry(ctx, "files.update", func(ctx context.Context) error {
+		call := d.update(src.ID, &drive.File{Name: newRef})
+		if addParents != "" {
+			call.AddParents(addParents).RemoveParents(removeParents)
+		}
+		_, err := call.Fields("id").Context(ctx).Do()
+		return err
+	})
+	if isNotFound(err) {
+		d.cache.Remove(oldRef)
+		return errors.E(op, errors.NotExist, err)
+	}
+	if err != nil {
+		return errors.E(op, errKind(err), err)
+	}
+	d.cache.Remove(oldRef)
+	d.addCache(newRef, src)
+	// As in Put, the previous file is only deleted once the renamed one is
+	// in place.
+	d.removeOld(ctx, op, newRef, old)
+	return nil
+}
+
+// moveShard returns the parents to add to and remove from the file with the
+// given ID for it to be stored in the subfolder of newRef, if it is not
+// there already.
+func (d *driveImpl) moveShard(ctx context.Context, id, newRef string) (add, remove string, err error) {
+	parents, err := d.parentsFor(ctx, newRef)
+	if err != nil {
+		return "", "", err
+	}
+	f, err := d.getFile(ctx, id, "parents")
+	if err != nil {
+		return "", "", err
+	}
+	if len(f.Parents) == 1 && f.Parents[0] == parents[0] {
+		return "", "", nil
+	}
+	return parents[0], strings.Join(f.Parents, ","), nil
+}
@@ -0,0 +1,37 @@
+package drive
+
+import (
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestRename(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("old", []byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	f.add("new", []byte("replaced"))
+	if err := d.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("download") + f.count("create"); n != 1 {
+		t.Errorf("got %d downloads and uploads, want only the one made by Put", n)
+	}
+	if _, err := d.Download("old"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download(old): got error %v, want NotExist", err)
+	}
+	if ids := f.named("new"); len(ids) != 1 {
+		t.Errorf("got %d files named new, want 1", len(ids))
+	}
+	got, err := d.Download("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "contents" {
+		t.Errorf("got %q, want %q", got, "contents")
+	}
+	if err := d.Rename("missing", "other"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v, want NotExist", err)
+	}
+}
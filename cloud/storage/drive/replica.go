@@ -0,0 +1,149 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+// replicaPrefix prefixes the options describing the replica, a secondary
+// storage to which the refs are replicated for redundancy, such as another
+// folder or another Drive account. The replica is configured by the options
+// of the storage, overridden by those prefixed by replicaPrefix: setting
+// "replica.parent" alone replicates to another folder of the same account,
+// while setting the token options replicates to another account. Puts and
+// Deletes are made on the storage then on the replica, and Downloads of refs
+// not found fall back to the replica.
+const replicaPrefix = "replica."
+
+// ReplicaError is held by the errors returned when an operation succeeded
+// on the storage but failed on its replica, which is then out of sync.
+type ReplicaError struct {
+	// Ref is the ref on which the operation failed.
+	Ref string
+	// Err is the error returned by the replica.
+	Err error
+}
+
+func (e *ReplicaError) Error() string {
+	return fmt.Sprintf("replica of %q is out of sync: %v", e.Ref, e.Err)
+}
+
+func (e *ReplicaError) Unwrap() error {
+	return e.Err
+}
+
+// replicaOpts returns the options of the replica described by o, or nil if
+// o describes none.
+func replicaOpts(o *storage.Opts) *storage.Opts {
+	m := make(map[string]string)
+	found := false
+	for k, v := range o.Opts {
+		if !strings.HasPrefix(k, replicaPrefix) {
+			if _, ok := m[k]; !ok {
+				m[k] = v
+			}
+			continue
+		}
+		m[strings.TrimPrefix(k, replicaPrefix)] = v
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return &storage.Opts{Opts: m}
+}
+
+// newReplica returns the replica described by o, if any, created with the
+// given options. The cache set by WithCache is not shared, as the IDs of the
+// replica's files differ from those of the storage, and the settings of the
+// typed options are already part of o, where the replica's override them.
+func newReplica(ctx context.Context, o *storage.Opts, opts []Option) (*driveImpl, error) {
+	ro := replicaOpts(o)
+	if ro == nil {
+		return nil, nil
+	}
+	opts = append(opts[:len(opts):len(opts)], func(o *options) {
+		o.cache = nil
+		o.settings = nil
+	})
+	s, err := NewWithContext(ctx, ro, opts...)
+	if err != nil {
+		kind := errors.Invalid
+		if e, ok := err.(*errors.Error); ok {
+			kind = e.Kind
+		}
+		return nil, errors.E(kind, &wrapError{msg: "replica", err: err})
+	}
+	return s.(*driveImpl), nil
+}
+
+// rereadable returns a reader reading the contents of r, which can be read
+// again by seeking back to the returned offset, along with their size if it
+// had to be computed. The contents of readers which can't seek are held in
+// memory.
+func rereadable(r io.Reader, size int64) (io.ReadSeeker, int64, int64, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		pos, err := rs.Seek(0, io.SeekCurrent)
+		return rs, pos, size, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return bytes.NewReader(b), 0, int64(len(b)), nil
+}
+
+// replicatePut stores the contents read from r in the replica, after they
+// were stored by d.
+func (d *driveImpl) replicatePut(ctx context.Context, op, ref string, r io.ReadSeeker, pos, size int64, contentType string) error {
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return errors.E(op, errors.IO, &ReplicaError{Ref: ref, Err: err})
+	}
+	if _, err := d.replica.put(ctx, ref, r, size, contentType); err != nil {
+		log.Error.Printf("%s: couldn't replicate %q: %v", op, ref, err)
+		return errors.E(op, errKind(err), &ReplicaError{Ref: ref, Err: err})
+	}
+	return nil
+}
+
+// deleteRef deletes the given ref on behalf of op, then deletes it from the
+// replica, if any. The ref is deleted from the replica even if it was not
+// stored, as it may have been put while the storage was failing.
+func (d *driveImpl) deleteRef(ctx context.Context, op, ref string, strict bool) error {
+	err := d.deletePrimary(ctx, op, ref, strict)
+	if d.replica == nil || (err != nil && !errors.Is(errors.NotExist, err)) {
+		return err
+	}
+	if rerr := d.replica.deleteRef(ctx, op, ref, false); rerr != nil {
+		log.Error.Printf("%s: couldn't delete replica of %q: %v", op, ref, rerr)
+		return errors.E(op, errKind(rerr), &ReplicaError{Ref: ref, Err: rerr})
+	}
+	return err
+}
+
+// downloadRef implements Download on behalf of op, reading refs which are not
+// stored from the replica, if any.
+func (d *driveImpl) downloadRef(ctx context.Context, op, ref string) ([]byte, *DownloadInfo, error) {
+	start := d.now()
+	b, info, err := d.downloadPrimary(ctx, op, ref)
+	if d.replica == nil || !errors.Is(errors.NotExist, err) {
+		return b, info, err
+	}
+	b, info, rerr := d.replica.downloadRef(ctx, op, ref)
+	if rerr != nil {
+		// The ref is missing from both.
+		return nil, nil, err
+	}
+	log.Info.Printf("%s: %q not found, read from the replica", op, ref)
+	info.CacheHit = false
+	info.Duration = d.now().Sub(start)
+	return b, info, nil
+}
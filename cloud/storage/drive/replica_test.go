@@ -0,0 +1,84 @@
+package drive
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+func TestReplicaOpts(t *testing.T) {
+	if ro := replicaOpts(&storage.Opts{Opts: map[string]string{"space": "drive"}}); ro != nil {
+		t.Errorf("got replica options %v without replica keys, want nil", ro.Opts)
+	}
+	ro := replicaOpts(&storage.Opts{Opts: map[string]string{
+		"space":                  "drive",
+		"parentFolderId":         "a",
+		"replica.parentFolderId": "b",
+	}})
+	want := map[string]string{"space": "drive", "parentFolderId": "b"}
+	if ro == nil || !reflect.DeepEqual(ro.Opts, want) {
+		t.Errorf("got replica options %v, want %v", ro, want)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	d, f := newTestDrive(t)
+	r, rf := newTestDrive(t)
+	d.replica = r
+
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	// Readers which can't seek are buffered to be read again.
+	if err := d.PutReader("big", strings.NewReader("big data"), -1); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"ref", "big"} {
+		if ids := rf.named(ref); len(ids) != 1 {
+			t.Errorf("got %d replicas of %q, want 1", len(ids), ref)
+		}
+	}
+
+	// Refs lost by the storage are read from the replica.
+	id := f.named("ref")[0]
+	f.mu.Lock()
+	delete(f.files, id)
+	f.mu.Unlock()
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("data")) {
+		t.Errorf("got %q from the replica, want %q", got, "data")
+	}
+
+	// Deletes reach the replica even if the storage lost the ref.
+	if err := d.Delete("ref"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := rf.named("ref"); len(ids) != 0 {
+		t.Errorf("got %d replicas of %q after Delete, want 0", len(ids), "ref")
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("got error %v downloading a deleted ref, want NotExist", err)
+	}
+
+	// Failures of the replica are reported once the storage succeeded.
+	rf.fail = func(string, *http.Request) int { return http.StatusForbidden }
+	err = d.Put("other", []byte("data"))
+	if re, ok := err.(*errors.Error).Err.(*ReplicaError); !ok || re.Ref != "other" {
+		t.Fatalf("got error %v when the replica fails, want a ReplicaError", err)
+	}
+	if ids := f.named("other"); len(ids) != 1 {
+		t.Errorf("got %d files for %q, want 1", len(ids), "other")
+	}
+	err = d.Delete("big")
+	if re, ok := err.(*errors.Error).Err.(*ReplicaError); !ok || re.Ref != "big" {
+		t.Errorf("got error %v when the replica fails, want a ReplicaError", err)
+	}
+}
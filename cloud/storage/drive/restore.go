@@ -0,0 +1,94 @@
+package drive
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+// Restore undoes the deletion of ref by the storage when the "softDelete"
+// option is set, by moving the file most recently trashed under its name,
+// and any parts of its contents, out of the trash. It returns an error of
+// kind errors.NotExist if there is no such file, and of kind errors.Exist
+// if ref is stored already.
+func (d *driveImpl) Restore(ref string) error {
+	const op = "cloud/storage/drive.Restore"
+	if err := d.checkOpen(op); err != nil {
+		return err
+	}
+	if err := d.checkWritable(op); err != nil {
+		return err
+	}
+	if err := checkRef(op, ref); err != nil {
+		return err
+	}
+	ctx := withTarget(context.Background(), op, ref)
+	_, err := d.fileEntry(ctx, ref)
+	switch {
+	case err == nil:
+		return errors.E(op, errors.Exist, errors.Errorf("%q is stored already", ref))
+	case !os.IsNotExist(err):
+		return errors.E(op, errKind(err), err)
+	}
+	files, err := d.listNamedIn(ctx, ref, "id, trashedTime, appProperties", true)
+	if err != nil {
+		return errors.E(op, errKind(err), err)
+	}
+	if len(files) == 0 {
+		return errors.E(op, errors.NotExist, errors.Errorf("no trashed file named %q", ref))
+	}
+	sortLastTrashedFirst(files)
+	e := fileCacheEntry(files[0])
+	// The parts are restored first, as the first part makes them visible.
+	for i := 1; i < e.Parts; i++ {
+		name := partName(ref, i)
+		parts, err := d.listNamedIn(ctx, name, "id, appProperties", true)
+		if err != nil {
+			return errors.E(op, errKind(err), err)
+		}
+		var id string
+		for _, f := range parts {
+			if f.AppProperties[partOfKey] == e.Version {
+				id = f.Id
+				break
+			}
+		}
+		if id == "" {
+			return errors.E(op, errors.NotExist, errors.Errorf("part %d of %d of %q is not in the trash", i, e.Parts, ref))
+		}
+		if err := d.untrash(ctx, id); err != nil {
+			return errors.E(op, errKind(err), err)
+		}
+	}
+	if err := d.untrash(ctx, e.ID); err != nil {
+		return errors.E(op, errKind(err), err)
+	}
+	d.addCache(ref, e)
+	return nil
+}
+
+// untrash moves the file with the given ID out of the trash.
+func (d *driveImpl) untrash(ctx context.Context, id string) error {
+	return d.retry(ctx, "files.update", func(ctx context.Context) error {
+		// Trashed must be sent although it holds its zero value.
+		f := &drive.File{Trashed: false, ForceSendFields: []string{"Trashed"}}
+		_, err := d.update(id, f).Fields("id").Context(ctx).Do()
+		return err
+	})
+}
+
+// sortLastTrashedFirst sorts files by decreasing trashedTime.
+func sortLastTrashedFirst(files []*drive.File) {
+	trashed := make(map[*drive.File]time.Time, len(files))
+	for _, f := range files {
+		// Zero times for unparseable values sort the file last.
+		trashed[f], _ = time.Parse(time.RFC3339, f.TrashedTime)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return trashed[files[i]].After(trashed[files[j]])
+	})
+}
@@ -0,0 +1,45 @@
+package drive
+
+import (
+	"testing"
+
+	"upspin.io/errors"
+)
+
+func TestRestore(t *testing.T) {
+	d, _ := newTestDrive(t)
+	d.softDelete = true
+	d.maxFileSize = 4
+	for ref, data := range map[string]string{"small": "abc", "large": "0123456789"} {
+		if err := d.Put(ref, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(ref); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Download(ref); !errors.Is(errors.NotExist, err) {
+			t.Fatalf("Download of deleted %q returned %v, want NotExist", ref, err)
+		}
+		if err := d.Restore(ref); err != nil {
+			t.Fatal(err)
+		}
+		for _, cached := range []bool{true, false} {
+			if !cached {
+				d.cache.Remove(ref)
+			}
+			got, err := d.Download(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Errorf("got %q for restored %q with cached=%v, want %q", got, ref, cached, data)
+			}
+		}
+		if err := d.Restore(ref); !errors.Is(errors.Exist, err) {
+			t.Errorf("Restore of stored %q returned %v, want Exist", ref, err)
+		}
+	}
+	if err := d.Restore("missing"); !errors.Is(errors.NotExist, err) {
+		t.Errorf("Restore of a ref never stored returned %v, want NotExist", err)
+	}
+}
@@ -0,0 +1,389 @@
+package drive
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+const (
+	// RetryMaxAttempts holds the default maximum number of times a Drive call
+	// is attempted before giving up. It may be overridden using the
+	// "retryMaxAttempts" option.
+	RetryMaxAttempts = 5
+
+	// RetryBaseDelay holds the default bound of the delay before the first
+	// retry, which doubles with each subsequent attempt up to RetryMaxDelay.
+	// They may be overridden using the "retryBaseDelay" and "retryMaxDelay"
+	// options.
+	RetryBaseDelay = 100 * time.Millisecond
+	RetryMaxDelay  = 10 * time.Second
+
+	// maxRetryDelay is the largest value allowed for "retryMaxDelay".
+	maxRetryDelay = time.Hour
+)
+
+// retry calls fn until it succeeds, returns an error which is not worth
+// retrying or the maximum number of attempts is reached. It returns the
+// last error returned by fn, or the context's error if ctx is done while
+// waiting for the next attempt. The method names the Drive API method called
+// by fn.
+func (d *driveImpl) retry(ctx context.Context, method string, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := d.call(ctx, method, fn)
+		if err == nil {
+			return nil
+		}
+		again, err := d.checkAppData(err)
+		if again {
+			// The storage now uses another space, so the call is new.
+			attempt--
+			continue
+		}
+		if !isRetryable(err) || attempt >= d.retryAttempts {
+			return err
+		}
+		delay, ok := retryAfter(err, d.now())
+		if !ok {
+			delay = d.backoff(attempt)
+		}
+		if d.onRetry != nil {
+			op, ref := retryTarget(ctx, method)
+			d.onRetry(op, ref, attempt, err)
+		}
+		if err := d.wait(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for delay to elapse before a retry, or returns the error of
+// ctx if it is done first.
+func (d *driveImpl) wait(ctx context.Context, delay time.Duration) error {
+	if d.sleep != nil {
+		return d.sleep(ctx, delay)
+	}
+	t := time.NewTimer(delay)
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
+
+// targetKey is the key of the context value holding the operation and ref
+// on behalf of which Drive calls are made.
+type targetKey struct{}
+
+// target is the value held under targetKey.
+type target struct {
+	op, ref string
+}
+
+// withTarget returns a copy of ctx recording that the Drive calls made with
+// it are made by op, on behalf of ref, for reporting retries.
+func withTarget(ctx context.Context, op, ref string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target{op: op, ref: ref})
+}
+
+// retryTarget returns the operation and ref recorded in ctx by withTarget,
+// or the Drive API method and no ref if there are none.
+func retryTarget(ctx context.Context, method string) (op, ref string) {
+	t, ok := ctx.Value(targetKey{}).(target)
+	if !ok {
+		return method, ""
+	}
+	return t.op, t.ref
+}
+
+// noTimeoutKey is the key of the context value marking the Drive calls
+// which are not limited by the request timeout as a whole.
+type noTimeoutKey struct{}
+
+// withoutTimeout returns a copy of ctx recording that the Drive calls made
+// with it apply the request timeout themselves, such as to each chunk of an
+// upload, rather than to the whole call.
+func withoutTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTimeoutKey{}, true)
+}
+
+// call calls fn once, with a context derived from ctx which is limited by
+// the request timeout unless marked by withoutTimeout, and reports the call
+// of the Drive API method to the metrics. If the number of concurrent calls
+// is limited, it first waits for a free slot, or until ctx is done.
+func (d *driveImpl) call(ctx context.Context, method string, fn func(context.Context) error) error {
+	if d.timeout > 0 && ctx.Value(noTimeoutKey{}) == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	if d.sem != nil {
+		select {
+		case d.sem <- struct{}{}:
+			defer func() { <-d.sem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.counts.inc(method)
+	if s, ok := opStatsFrom(ctx); ok {
+		atomic.AddInt64(&s.calls, 1)
+	}
+	start := d.now()
+	err := fn(ctx)
+	d.metrics.Call(method, d.now().Sub(start), err)
+	if isRateLimit(err) {
+		d.metrics.RateLimited(method)
+	}
+	if isStorageQuotaExceeded(err) {
+		err = &StorageQuotaError{Err: err.(*googleapi.Error)}
+	}
+	return err
+}
+
+// backoff returns the time to wait before making the next call, after the
+// given number of attempts have failed. It is chosen randomly between
+// zero and an exponentially increasing upper bound.
+func (d *driveImpl) backoff(attempt int) time.Duration {
+	max := d.retryBaseDelay
+	for i := 1; i < attempt && max < d.retryMaxDelay; i++ {
+		max *= 2
+	}
+	if max > d.retryMaxDelay {
+		max = d.retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// Drive error err, if any. The header holds either a number of seconds or
+// an HTTP date.
+func retryAfter(err error, now time.Time) (time.Duration, bool) {
+	e, ok := err.(*googleapi.Error)
+	if !ok || e.Header == nil {
+		return 0, false
+	}
+	v := e.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// isRetryable reports whether err is a transient Drive error, such as a rate
+// limit being hit or a server-side failure, or a truncated download.
+func isRetryable(err error) bool {
+	if _, ok := err.(*truncatedError); ok {
+		return true
+	}
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		return isRateLimit(err)
+	}
+	return false
+}
+
+// isRateLimit reports whether err is a Drive error caused by a rate limit
+// being exceeded.
+func isRateLimit(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if e.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// isStorageQuotaExceeded reports whether err is a Drive error caused by the
+// storage quota of the Drive being exhausted. Unlike rate limits, which are
+// reported with the same status code, it persists until space is freed.
+func isStorageQuotaExceeded(err error) bool {
+	e, ok := googleErr(err)
+	if !ok || e.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "storageQuotaExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err is a Drive error reporting that the file
+// does not exist.
+func isNotFound(err error) bool {
+	e, ok := googleErr(err)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// googleErr returns the Drive API error held by err, if any.
+func googleErr(err error) (*googleapi.Error, bool) {
+	e, ok := err.(*googleapi.Error)
+	return e, ok
+}
+
+// isScopeError reports whether err is a Drive error caused by the
+// credentials lacking the scope required by the request.
+func isScopeError(err error) bool {
+	e, ok := googleErr(err)
+	if !ok || e.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "insufficientScopes" || item.Reason == "insufficientPermissions" {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppDataNotFound reports whether err is the failure Drive reports for
+// some credentials lacking the drive.appdata scope, which don't see the
+// appDataFolder at all.
+func isAppDataNotFound(err error) bool {
+	e, ok := googleErr(err)
+	if !ok || e.Code != http.StatusNotFound {
+		return false
+	}
+	if strings.Contains(e.Message, "appDataFolder") {
+		return true
+	}
+	for _, item := range e.Errors {
+		if strings.Contains(item.Message, "appDataFolder") {
+			return true
+		}
+	}
+	return false
+}
+
+// errKind returns the kind of the error to report for the failure of a
+// Drive call: errors.Permission when the credentials were rejected or don't
+// grant access to the file, errors.Invalid when the file can't be read by
+// the storage, and errors.IO otherwise.
+func errKind(err error) errors.Kind {
+	switch {
+	case isAuthError(err) || errors.Is(errors.Permission, err):
+		return errors.Permission
+	case errors.Is(errors.Invalid, err):
+		return errors.Invalid
+	}
+	return errors.IO
+}
+
+// isAuthError reports whether err is caused by the credentials being
+// invalid, revoked or insufficient.
+func isAuthError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		// Failures to refresh the token are reported by the transport.
+		_, ok := e.Err.(*oauth2.RetrieveError)
+		return ok
+	}
+	e, ok := googleErr(err)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		for _, item := range e.Errors {
+			if item.Reason == "insufficientPermissions" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryOpts sets how d makes and retries Drive calls from the options.
+func (d *driveImpl) retryOpts(o *storage.Opts) error {
+	attempts, err := intOpt(o, "retryMaxAttempts", RetryMaxAttempts)
+	if err != nil {
+		return err
+	}
+	if attempts < 1 {
+		return errors.Errorf("retryMaxAttempts must be positive, got %d", attempts)
+	}
+	baseDelay, err := durationOpt(o, "retryBaseDelay", RetryBaseDelay)
+	if err != nil {
+		return err
+	}
+	if baseDelay <= 0 {
+		return errors.Errorf("retryBaseDelay must be positive, got %v", baseDelay)
+	}
+	maxDelay, err := durationOpt(o, "retryMaxDelay", RetryMaxDelay)
+	if err != nil {
+		return err
+	}
+	if maxDelay < baseDelay || maxDelay > maxRetryDelay {
+		return errors.Errorf("retryMaxDelay must be between retryBaseDelay (%v) and %v, got %v", baseDelay, maxRetryDelay, maxDelay)
+	}
+	timeout, err := durationOpt(o, "requestTimeout", RequestTimeout)
+	if err != nil {
+		return err
+	}
+	if timeout < 0 {
+		return errors.Errorf("requestTimeout can not be negative, got %v", timeout)
+	}
+	maxConcurrency, err := intOpt(o, "maxConcurrency", 0)
+	if err != nil {
+		return err
+	}
+	if maxConcurrency < 0 {
+		return errors.Errorf("maxConcurrency can not be negative, got %d", maxConcurrency)
+	}
+	d.retryAttempts = attempts
+	d.retryBaseDelay = baseDelay
+	d.retryMaxDelay = maxDelay
+	d.timeout = timeout
+	if maxConcurrency > 0 {
+		d.sem = make(chan struct{}, maxConcurrency)
+	}
+	return nil
+}
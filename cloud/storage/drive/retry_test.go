@@ -0,0 +1,388 @@
+package drive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"upspin.io/errors"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.Str("boom"), false},
+		{&googleapi.Error{Code: 401}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 403}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "storageQuotaExceeded"}}}, false},
+	} {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrKind(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want errors.Kind
+	}{
+		{errors.Str("boom"), errors.IO},
+		{&googleapi.Error{Code: 401}, errors.Permission},
+		{&googleapi.Error{Code: 403}, errors.IO},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, errors.Permission},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, errors.IO},
+		{&googleapi.Error{Code: 500}, errors.IO},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &oauth2.RetrieveError{}}, errors.Permission},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: errors.Str("boom")}, errors.IO},
+	} {
+		if got := errKind(tt.err); got != tt.want {
+			t.Errorf("errKind(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStorageQuotaExceeded(t *testing.T) {
+	for _, tt := range []struct {
+		reason string
+		calls  int
+		quota  bool
+	}{
+		{"rateLimitExceeded", 3, false},
+		{"userRateLimitExceeded", 3, false},
+		{"storageQuotaExceeded", 1, true},
+	} {
+		d, f := newTestDrive(t)
+		d.retryAttempts = 3
+		f.failReason = tt.reason
+		f.fail = func(method string, r *http.Request) int {
+			if method == "create" {
+				return http.StatusForbidden
+			}
+			return 0
+		}
+		err := d.Put("ref", []byte("data"))
+		if !errors.Is(errors.IO, err) {
+			t.Errorf("%s: got error %v, want IO", tt.reason, err)
+		}
+		if n := f.count("create"); n != tt.calls {
+			t.Errorf("%s: got %d create calls, want %d", tt.reason, n, tt.calls)
+		}
+		if got := IsStorageQuotaExceeded(err); got != tt.quota {
+			t.Errorf("%s: IsStorageQuotaExceeded(%v) = %v, want %v", tt.reason, err, got, tt.quota)
+		}
+		if e, ok := DriveError(err); !ok || e.Errors[0].Reason != tt.reason {
+			t.Errorf("%s: DriveError(%v) doesn't report the Drive error", tt.reason, err)
+		}
+	}
+}
+
+func TestDriveError(t *testing.T) {
+	for _, tt := range []struct {
+		code      int
+		reason    string
+		noAppData bool
+	}{
+		{http.StatusInternalServerError, "backendError", false},
+		{http.StatusForbidden, "storageQuotaExceeded", false},
+		{http.StatusForbidden, "insufficientScopes", true},
+	} {
+		d, f := newTestDrive(t)
+		f.noAppData = tt.noAppData
+		if !tt.noAppData {
+			f.failReason = tt.reason
+			f.fail = func(method string, r *http.Request) int { return tt.code }
+		}
+		err := d.Put("ref", []byte("data"))
+		e, ok := DriveError(err)
+		if !ok {
+			t.Errorf("%s: DriveError(%v) found no Drive error", tt.reason, err)
+			continue
+		}
+		if e.Code != tt.code || len(e.Errors) != 1 || e.Errors[0].Reason != tt.reason {
+			t.Errorf("%s: got Drive error %v, want code %d", tt.reason, e, tt.code)
+		}
+	}
+	if _, ok := DriveError(errors.E(errors.IO, errors.Str("boom"))); ok {
+		t.Errorf("DriveError found a Drive error in a plain error")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, d := range []*driveImpl{
+		{retryBaseDelay: RetryBaseDelay, retryMaxDelay: RetryMaxDelay},
+		{retryBaseDelay: time.Second, retryMaxDelay: time.Hour},
+	} {
+		for attempt := 1; attempt < 100; attempt++ {
+			max := d.retryMaxDelay
+			if attempt < 10 {
+				max = d.retryBaseDelay << uint(attempt-1)
+				if max > d.retryMaxDelay {
+					max = d.retryMaxDelay
+				}
+			}
+			if got := d.backoff(attempt); got < 0 || got > max {
+				t.Errorf("backoff(%d) with base %v = %v, want between 0 and %v", attempt, d.retryBaseDelay, got, max)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d := &driveImpl{retryAttempts: 3, metrics: nopMetrics{}, now: time.Now}
+	var calls int
+	err := d.retry(context.Background(), "test", func(context.Context) error {
+		calls++
+		return &googleapi.Error{Code: 404}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("got %d calls (err %v), want 1 call and an error", calls, err)
+	}
+	calls = 0
+	start := time.Now()
+	err = d.retry(context.Background(), "test", func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("got %d calls (err %v), want 3 calls and no error", calls, err)
+	}
+	if max := RetryBaseDelay * 3; time.Since(start) > max+time.Second {
+		t.Errorf("retries took too long: %v", time.Since(start))
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	d := &driveImpl{retryAttempts: 100, metrics: nopMetrics{}, now: time.Now}
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	err := d.retry(ctx, "test", func(ctx context.Context) error {
+		calls++
+		cancel()
+		return &googleapi.Error{Code: 503}
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Fatalf("got %d calls (err %v), want 1 call and %v", calls, err, context.Canceled)
+	}
+}
+
+func TestListTimeout(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.timeout = 50 * time.Millisecond
+	f.add("ref", []byte("data"))
+	f.fail = func(method string, r *http.Request) int {
+		if method == "list" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return 0
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.timeout = 50 * time.Millisecond
+	f.add("ref", []byte("data"))
+	f.fail = func(method string, r *http.Request) int {
+		if method == "download" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return 0
+	}
+	if _, err := d.Download("ref"); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+}
+
+func TestChunkTimeout(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.timeout = 200 * time.Millisecond
+	d.chunkSize = googleapi.MinUploadChunkSize
+	data := bytes.Repeat([]byte("x"), 3*googleapi.MinUploadChunkSize+100)
+	f.fail = func(method string, r *http.Request) int {
+		if method == "upload" {
+			// Each chunk fits in the timeout, but not all of them.
+			time.Sleep(100 * time.Millisecond)
+		}
+		return 0
+	}
+	if err := d.Put("ref", data); err != nil {
+		t.Fatalf("slow chunked upload: %v", err)
+	}
+	if n := f.count("upload"); n < 3 {
+		t.Errorf("got %d chunks uploaded, want at least 3", n)
+	}
+	f.fail = func(method string, r *http.Request) int {
+		if method == "upload" {
+			time.Sleep(time.Second)
+		}
+		return 0
+	}
+	if err := d.Put("stuck", data); !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v for a stuck chunk, want IO", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	header := func(v string) http.Header {
+		return http.Header{"Retry-After": []string{v}}
+	}
+	now := time.Date(2015, 10, 22, 7, 0, 0, 0, time.UTC)
+	date := now.Add(time.Minute).Format(http.TimeFormat)
+	for _, tt := range []struct {
+		err  error
+		want time.Duration
+		ok   bool
+	}{
+		{errors.Str("boom"), 0, false},
+		{&googleapi.Error{Code: 429}, 0, false},
+		{&googleapi.Error{Code: 429, Header: header("2")}, 2 * time.Second, true},
+		{&googleapi.Error{Code: 429, Header: header("0")}, 0, true},
+		{&googleapi.Error{Code: 429, Header: header("-1")}, 0, false},
+		{&googleapi.Error{Code: 429, Header: header("soon")}, 0, false},
+		{&googleapi.Error{Code: 503, Header: header("Wed, 21 Oct 2015 07:28:00 GMT")}, 0, true},
+	} {
+		got, ok := retryAfter(tt.err, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%v) = %v, %v; want %v, %v", tt.err, got, ok, tt.want, tt.ok)
+		}
+	}
+	got, ok := retryAfter(&googleapi.Error{Code: 429, Header: header(date)}, now)
+	if !ok || got != time.Minute {
+		t.Errorf("retryAfter(%s) = %v, %v; want a minute", date, got, ok)
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		retryAfter string
+		want       time.Duration
+	}{
+		{"2", 2 * time.Second},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	} {
+		var delays []time.Duration
+		d := &driveImpl{
+			retryAttempts: 2,
+			metrics:       nopMetrics{},
+			now:           func() time.Time { return now },
+			sleep: func(ctx context.Context, delay time.Duration) error {
+				delays = append(delays, delay)
+				return nil
+			},
+		}
+		var calls int
+		err := d.retry(context.Background(), "test", func(context.Context) error {
+			if calls++; calls == 1 {
+				return &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": []string{tc.retryAfter}}}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(delays) != 1 || delays[0] != tc.want {
+			t.Errorf("Retry-After %q: waited %v, want [%v]", tc.retryAfter, delays, tc.want)
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.sem = make(chan struct{}, 2)
+	d.concurrency = 8
+	var inFlight, peak int32
+	f.fail = func(method string, r *http.Request) int {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&peak)
+			if n <= m || atomic.CompareAndSwapInt32(&peak, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return 0
+	}
+	entries := make(map[string][]byte)
+	for i := 0; i < 16; i++ {
+		entries[fmt.Sprintf("ref%d", i)] = []byte("data")
+	}
+	if err := d.PutBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&peak); n > 2 {
+		t.Errorf("got %d concurrent requests, want at most 2", n)
+	}
+}
+
+func TestOnRetry(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.add("ref", []byte("data"))
+	var failures int
+	f.fail = func(method string, r *http.Request) int {
+		if method == "download" && failures < 2 {
+			failures++
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+	type retried struct {
+		op, ref string
+		attempt int
+	}
+	var got []retried
+	d.onRetry = func(op, ref string, attempt int, err error) {
+		if err == nil {
+			t.Errorf("retry %d of %s notified without an error", attempt, op)
+		}
+		got = append(got, retried{op, ref, attempt})
+	}
+	if _, err := d.Download("ref"); err != nil {
+		t.Fatal(err)
+	}
+	want := []retried{
+		{"cloud/storage/drive.Download", "ref", 1},
+		{"cloud/storage/drive.Download", "ref", 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got retries %v, want %v", got, want)
+	}
+
+	// Calls made on behalf of no operation are reported by method.
+	got = nil
+	calls := 0
+	d.retry(context.Background(), "files.test", func(context.Context) error {
+		if calls++; calls == 1 {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	})
+	if want := []retried{{"files.test", "", 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got retries %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// folderMimeType is the MIME type of Drive folders.
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// notFolderQuery is a Drive query matching files which are not folders.
+const notFolderQuery = "mimeType != '" + folderMimeType + "'"
+
+// shardName returns the name of the subfolder in which the given ref is
+// stored when sharding is enabled: the first shardLen characters of the ref.
+func (d *driveImpl) shardName(ref string) string {
+	if len(ref) <= d.shardLen {
+		return ref
+	}
+	return ref[:d.shardLen]
+}
+
+// parentsFor returns the parents of the file created by d for the given
+// ref. When sharding is enabled, that is its subfolder, which is created
+// if needed.
+func (d *driveImpl) parentsFor(ctx context.Context, ref string) ([]string, error) {
+	if d.shardLen == 0 {
+		return d.parents(), nil
+	}
+	id, err := d.shardFolder(ctx, d.shardName(ref), true)
+	if err != nil {
+		return nil, err
+	}
+	return []string{id}, nil
+}
+
+// shardFolder returns the ID of the subfolder with the given name, creating
+// it if it does not exist and create is set. Otherwise the ID of a missing
+// folder is empty. Folder IDs are cached, as folders are never deleted.
+func (d *driveImpl) shardFolder(ctx context.Context, name string, create bool) (string, error) {
+	if id, ok := d.shards.Load(name); ok {
+		return id.(string), nil
+	}
+	key := name
+	if create {
+		// Lookups which may not create the folder don't satisfy those
+		// which must.
+		key += "\x00create"
+	}
+	v, err, _ := d.shardLookups.Do(key, func() (interface{}, error) {
+		id, err := d.lookupShard(ctx, name)
+		if err != nil || id != "" || !create {
+			return id, err
+		}
+		err = d.retry(ctx, "files.create", func(ctx context.Context) error {
+			_, err := d.create(&drive.File{
+				Name:          name,
+				MimeType:      folderMimeType,
+				Parents:       d.parents(),
+				AppProperties: d.newProps(),
+			}).Fields("id").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		// Another client may have created the folder concurrently, so
+		// look it up again to agree on the oldest one.
+		return d.lookupShard(ctx, name)
+	})
+	if err != nil {
+		return "", err
+	}
+	id := v.(string)
+	if id != "" {
+		d.shards.Store(name, id)
+	}
+	return id, nil
+}
+
+// lookupShard lists the subfolders with the given name and returns the ID
+// of the oldest one, or the empty string if there is none.
+func (d *driveImpl) lookupShard(ctx context.Context, name string) (string, error) {
+	q := fmt.Sprintf("mimeType = '%s' and %s", folderMimeType, nameQuery(name))
+	folders, err := d.listPages(ctx, "id, createdTime", func() *drive.FilesListCall {
+		return d.listIn(d.baseFolder(), q)
+	})
+	if err != nil || len(folders) == 0 {
+		return "", err
+	}
+	sortNewestFirst(folders)
+	return folders[len(folders)-1].Id, nil
+}
+
+// listShard returns the given fields of the files stored under the given
+// name, looking in its subfolder as well as at the top level, where files
+// stored before sharding was enabled are found. If trashed is set, the files
+// in the trash are listed instead.
+func (d *driveImpl) listShard(ctx context.Context, name, fields string, trashed bool) ([]*drive.File, error) {
+	folders := []string{d.baseFolder()}
+	id, err := d.shardFolder(ctx, d.shardName(name), false)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		folders = append(folders, id)
+	}
+	q := strings.Join([]string{nameQuery(name), notFolderQuery, inAnyQuery(folders)}, " and ")
+	return d.listPages(ctx, fields, func() *drive.FilesListCall {
+		return d.listFiles("", q, trashed)
+	})
+}
+
+// listSharded is like listAll when sharding is enabled. Listing a parent
+// folder only finds its direct children, so the subfolders are listed as
+// well.
+func (d *driveImpl) listSharded(ctx context.Context, q, fields string) ([]*drive.File, error) {
+	if q == "" {
+		q = notFolderQuery
+	} else {
+		q += " and " + notFolderQuery
+	}
+	files, err := d.listPages(ctx, fields, func() *drive.FilesListCall { return d.list(q) })
+	if err != nil || d.parent == "" {
+		// Without a parent folder, the listing covers the whole space.
+		return files, err
+	}
+	folderQ := fmt.Sprintf("mimeType = '%s'", folderMimeType)
+	folders, err := d.listPages(ctx, "id", func() *drive.FilesListCall {
+		return d.list(folderQ)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		id := folder.Id
+		more, err := d.listPages(ctx, fields, func() *drive.FilesListCall {
+			return d.listIn(id, q)
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, more...)
+	}
+	return files, nil
+}
+
+// baseFolder returns the ID of the folder in which d stores files, or in
+// which the subfolders are created when sharding is enabled, as used in
+// queries.
+func (d *driveImpl) baseFolder() string {
+	if p := d.parents(); len(p) > 0 {
+		return p[0]
+	}
+	return "root"
+}
+
+// inAnyQuery returns a Drive query matching files in any of the folders with
+// the given IDs.
+func inAnyQuery(folders []string) string {
+	clauses := make([]string, len(folders))
+	for i, id := range folders {
+		clauses[i] = fmt.Sprintf("'%s' in parents", queryEscaper.Replace(id))
+	}
+	return "(" + strings.Join(clauses, " or ") + ")"
+}
+
+// shardOpts sets the length of the prefixes by which d shards refs into
+// subfolders from the options.
+func (d *driveImpl) shardOpts(o *storage.Opts) error {
+	shardLen, err := intOpt(o, "shardPrefixLength", 0)
+	if err != nil {
+		return err
+	}
+	if shardLen < 0 {
+		return errors.Errorf("shardPrefixLength can not be negative, got %d", shardLen)
+	}
+	d.shardLen = shardLen
+	return nil
+}
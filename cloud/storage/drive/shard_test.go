@@ -0,0 +1,115 @@
+package drive
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestShards(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.shardLen = 2
+	f.add("abold", []byte("abold"))
+	refs := []string{"ab12", "ab34", "cd56"}
+	for _, ref := range refs {
+		if err := d.Put(ref, []byte(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folders := make(map[string]string)
+	for _, name := range []string{"ab", "cd"} {
+		ids := f.named(name)
+		if len(ids) != 1 {
+			t.Fatalf("got %d folders named %q, want 1", len(ids), name)
+		}
+		if typ := f.file(ids[0]).MimeType; typ != folderMimeType {
+			t.Errorf("folder %q has type %q", name, typ)
+		}
+		folders[name] = ids[0]
+	}
+	for _, ref := range refs {
+		p := f.file(f.named(ref)[0]).Parents
+		if want := []string{folders[ref[:2]]}; !reflect.DeepEqual(p, want) {
+			t.Errorf("%q has parents %v, want %v", ref, p, want)
+		}
+	}
+
+	// Start afresh, as another client would.
+	forget(d)
+	for _, ref := range append(refs, "abold") {
+		got, err := d.Download(ref)
+		if err != nil {
+			t.Fatalf("Download(%q): %v", ref, err)
+		}
+		if string(got) != ref {
+			t.Errorf("Download(%q) = %q, want %q", ref, got, ref)
+		}
+	}
+	list, err := d.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 {
+		t.Errorf("List returned %d entries, want 4: %v", len(list), list)
+	}
+
+	forget(d)
+	if err := d.Rename("ab12", "cd78"); err != nil {
+		t.Fatal(err)
+	}
+	id := f.named("cd78")[0]
+	if p := f.file(id).Parents; !reflect.DeepEqual(p, []string{folders["cd"]}) {
+		t.Errorf("renamed file has parents %v, want %v", p, []string{folders["cd"]})
+	}
+	if err := d.Delete("abold"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := f.named("abold"); len(ids) != 0 {
+		t.Errorf("file stored before sharding was not deleted")
+	}
+	if n := len(f.named("ab")) + len(f.named("cd")); n != 2 {
+		t.Errorf("got %d folders, want 2", n)
+	}
+}
+
+func TestShardsInParent(t *testing.T) {
+	d, f := newTestDrive(t)
+	f.mu.Lock()
+	parent := f.addLocked(&fakeFile{File: drive.File{Name: "upspin", MimeType: folderMimeType}})
+	f.mu.Unlock()
+	d.space = "drive"
+	d.parent = parent
+	d.shardLen = 1
+	for _, ref := range []string{"a1", "a2", "b1"} {
+		if err := d.Put(ref, []byte(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := d.DeleteByPrefix("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("DeleteByPrefix deleted %d files, want 2", n)
+	}
+	list, err := d.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Ref != "b1" {
+		t.Errorf("List returned %v, want b1 only", list)
+	}
+	if ids := f.named("a"); len(ids) != 1 {
+		t.Errorf("got %d folders named a, want 1", len(ids))
+	}
+}
+
+// forget empties the caches of d.
+func forget(d *driveImpl) {
+	d.cache = newLRUCache(LRUSize)
+	d.shards.Range(func(k, _ interface{}) bool {
+		d.shards.Delete(k)
+		return true
+	})
+}
@@ -0,0 +1,58 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+)
+
+// SharingError is returned when the contents of a ref were stored but the
+// file holding them could not be made readable by anyone with its link, as
+// requested by the "publicLinks" option. Retrying the Put shares the new
+// file again.
+type SharingError struct {
+	// Ref is the ref whose contents were stored.
+	Ref string
+	// Err holds the error returned by the Drive API.
+	Err error
+}
+
+func (e *SharingError) Error() string {
+	return fmt.Sprintf("stored %q but couldn't share it: %v", e.Ref, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SharingError) Unwrap() error {
+	return e.Err
+}
+
+// share grants anyone with the link read access to the file with the given
+// ID, so that it can be downloaded without credentials.
+func (d *driveImpl) share(ctx context.Context, id string) error {
+	return d.retry(ctx, "permissions.create", func(ctx context.Context) error {
+		call := d.permissions.Create(id, &drive.Permission{Type: "anyone", Role: "reader"})
+		if d.supportsAllDrives() {
+			call.SupportsAllDrives(true)
+		}
+		_, err := call.Fields("id").Context(ctx).Do()
+		return err
+	})
+}
+
+// shareOpts sets whether d shares the files it stores from the options.
+func (d *driveImpl) shareOpts(o *storage.Opts) error {
+	// Sharing is a security trade-off: the contents of every stored file
+	// become readable by anyone who learns its ID. It is off by default.
+	publicLinks, err := boolOpt(o, "publicLinks")
+	if err != nil {
+		return err
+	}
+	if publicLinks && d.space == "appDataFolder" {
+		return errors.Errorf("publicLinks can not be used with the appDataFolder space, whose files can't be shared")
+	}
+	d.publicLinks = publicLinks
+	return nil
+}
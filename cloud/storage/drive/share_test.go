@@ -0,0 +1,52 @@
+package drive
+
+import (
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+func TestPublicLinks(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.space = "drive"
+	d.publicLinks = true
+	if err := d.Put("ref", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy("ref", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	want := drive.Permission{Type: "anyone", Role: "reader"}
+	for _, ref := range []string{"ref", "copy"} {
+		id := f.named(ref)[0]
+		f.mu.Lock()
+		perms := f.files[id].perms
+		f.mu.Unlock()
+		if len(perms) != 1 || perms[0].Type != want.Type || perms[0].Role != want.Role {
+			t.Errorf("%q has permissions %+v, want %+v", ref, perms, want)
+		}
+	}
+
+	f.fail = func(method string, r *http.Request) int {
+		if method == "permission" {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	err := d.Put("ref", []byte("new data"))
+	if !errors.Is(errors.IO, err) {
+		t.Errorf("got error %v, want IO", err)
+	}
+	if _, ok := err.(*errors.Error).Err.(*SharingError); !ok {
+		t.Errorf("got error %v, want a *SharingError", err)
+	}
+	got, err := d.Download("ref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new data" {
+		t.Errorf("got %q, want the stored contents", got)
+	}
+}
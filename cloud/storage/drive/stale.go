@@ -0,0 +1,113 @@
+package drive
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/cloud/storage"
+	"upspin.io/errors"
+	"upspin.io/log"
+)
+
+const (
+	// StaleRefThreshold holds the default number of consecutive times the
+	// cached ID of a ref must be found stale by Download before a warning
+	// is logged. It may be overridden using the "staleRefThreshold" option.
+	StaleRefThreshold = 2
+
+	// StaleCacheThreshold holds the default number of consecutive cached
+	// IDs which must be found stale by Download, whatever their ref, before
+	// the cache is considered wholesale stale, as happens when another
+	// client rewrote many files. It may be overridden using the
+	// "staleCacheThreshold" option, where zero disables the check.
+	StaleCacheThreshold = 10
+
+	// StaleCacheBypass holds the default duration for which the cache is
+	// bypassed once it is considered wholesale stale. It may be overridden
+	// using the "staleCacheBypass" option.
+	StaleCacheBypass = time.Minute
+)
+
+// staleTracker tracks the cached IDs found to be stale, to protect against
+// a cache which went wholesale stale. Its zero value never trips.
+type staleTracker struct {
+	refThreshold int
+	threshold    int
+	bypass       time.Duration
+
+	mu sync.Mutex
+	// refs counts the consecutive stale IDs of each ref.
+	refs map[string]int
+	// misses counts the consecutive stale IDs of any ref.
+	misses int
+	// tripped is the time at which the cache was last considered stale,
+	// before which all entries are ignored.
+	tripped time.Time
+}
+
+// staleHit records that the cached ID of ref was found stale.
+func (s *staleTracker) staleHit(ref string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == nil || len(s.refs) >= LRUSize {
+		// Refs which are never read again would otherwise pile up.
+		s.refs = make(map[string]int)
+	}
+	s.refs[ref]++
+	if n := s.refs[ref]; s.refThreshold > 0 && n >= s.refThreshold {
+		log.Info.Printf("cloud/storage/drive: cached ID of %q found stale %d times in a row", ref, n)
+	}
+	s.misses++
+	if s.threshold > 0 && s.misses >= s.threshold {
+		log.Error.Printf("cloud/storage/drive: %d cached IDs found stale in a row, bypassing the cache for %v", s.misses, s.bypass)
+		s.tripped = now
+		s.misses = 0
+	}
+}
+
+// freshHit records that the cached ID of ref was valid.
+func (s *staleTracker) freshHit(ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refs, ref)
+	s.misses = 0
+}
+
+// ignore reports whether the cache entry added at the given time must be
+// ignored: entries are ignored while the cache is bypassed, and those added
+// before it was last considered stale are never used again.
+func (s *staleTracker) ignore(added, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tripped.IsZero() {
+		return false
+	}
+	return added.Before(s.tripped) || now.Sub(s.tripped) < s.bypass
+}
+
+// staleOpts sets the thresholds at which d considers its cache stale from
+// the options.
+func (d *driveImpl) staleOpts(o *storage.Opts) error {
+	refThreshold, err := intOpt(o, "staleRefThreshold", StaleRefThreshold)
+	if err != nil {
+		return err
+	}
+	threshold, err := intOpt(o, "staleCacheThreshold", StaleCacheThreshold)
+	if err != nil {
+		return err
+	}
+	if refThreshold < 0 || threshold < 0 {
+		return errors.Errorf("staleRefThreshold and staleCacheThreshold can not be negative")
+	}
+	bypass, err := durationOpt(o, "staleCacheBypass", StaleCacheBypass)
+	if err != nil {
+		return err
+	}
+	if bypass < 0 {
+		return errors.Errorf("staleCacheBypass can not be negative, got %v", bypass)
+	}
+	d.stale.refThreshold = refThreshold
+	d.stale.threshold = threshold
+	d.stale.bypass = bypass
+	return nil
+}
@@ -0,0 +1,91 @@
+package drive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleCache(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.stale.refThreshold = 2
+	d.stale.threshold = 3
+	refs := []string{"a", "b", "c", "x"}
+	for _, ref := range refs {
+		if err := d.Put(ref, []byte(ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another client rewrites most files, leaving the cached IDs stale.
+	for _, ref := range refs[:3] {
+		id := f.named(ref)[0]
+		f.mu.Lock()
+		delete(f.files, id)
+		f.mu.Unlock()
+		f.add(ref, []byte("new "+ref))
+	}
+	for _, ref := range refs[:2] {
+		if _, err := d.Download(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A valid cached ID resets the count.
+	if _, info, err := d.DownloadWithInfo("x"); err != nil || !info.CacheHit {
+		t.Fatalf("got cache hit %v (error %v) before the cache was found stale, want true", info != nil && info.CacheHit, err)
+	}
+	if _, err := d.Download("c"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.stale.tripped.IsZero() {
+		t.Fatalf("cache considered stale despite a valid cached ID")
+	}
+	for _, ref := range refs[:3] {
+		id := f.named(ref)[0]
+		f.mu.Lock()
+		delete(f.files, id)
+		f.mu.Unlock()
+		f.add(ref, []byte(ref))
+		if _, err := d.Download(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.stale.tripped.IsZero() {
+		t.Fatalf("cache not considered stale after %d stale IDs", d.stale.threshold)
+	}
+	// Entries cached before are ignored from then on, while new ones are
+	// used once the bypass is over.
+	if _, info, err := d.DownloadWithInfo("x"); err != nil || info.CacheHit {
+		t.Errorf("got cache hit %v (error %v) for an entry cached before, want false", info != nil && info.CacheHit, err)
+	}
+	if _, info, err := d.DownloadWithInfo("x"); err != nil || !info.CacheHit {
+		t.Errorf("got cache hit %v (error %v) for a new entry, want true", info != nil && info.CacheHit, err)
+	}
+
+	d.stale.bypass = time.Hour
+	d.stale.tripped = time.Now()
+	if _, info, err := d.DownloadWithInfo("x"); err != nil || info.CacheHit {
+		t.Errorf("got cache hit %v (error %v) while bypassing the cache, want false", info != nil && info.CacheHit, err)
+	}
+}
+
+func TestStaleRange(t *testing.T) {
+	d, f := newTestDrive(t)
+	if err := d.Put("ref", []byte("old contents")); err != nil {
+		t.Fatal(err)
+	}
+	// Another client rewrites the file, leaving the cached ID stale.
+	id := f.named("ref")[0]
+	f.mu.Lock()
+	delete(f.files, id)
+	f.mu.Unlock()
+	f.add("ref", []byte("new contents"))
+	got, err := d.DownloadRange("ref", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+	if n := d.stale.refs["ref"]; n != 1 {
+		t.Errorf("got %d stale hits recorded, want 1", n)
+	}
+}
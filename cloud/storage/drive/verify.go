@@ -0,0 +1,119 @@
+package drive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+	"upspin.io/errors"
+)
+
+// Verify checks the integrity of all the stored files, and returns the
+// sorted refs of those which failed the check. Each file is downloaded, up
+// to the configured number of them concurrently, and its MD5 checksum is
+// compared with the one Drive computed when it was stored. The contents of
+// encrypted and compressed files must also decode. Google-native files,
+// which have no checksum, are not checked.
+//
+// Files deleted while Verify runs are skipped. If some files could not be
+// checked, the error holds a *BatchError keyed by file ID.
+func (d *driveImpl) Verify(ctx context.Context) ([]string, error) {
+	const op = "cloud/storage/drive.Verify"
+	if err := d.checkOpen(op); err != nil {
+		return nil, err
+	}
+	files, err := d.listAll(ctx, notFolderQuery, "id, name, mimeType, md5Checksum, appProperties")
+	if err != nil {
+		return nil, errors.E(op, errKind(err), err)
+	}
+	var (
+		mu     sync.Mutex
+		ids    = make([]string, 0, len(files))
+		byId   = make(map[string]*drive.File)
+		failed = make(map[string]bool)
+	)
+	for _, f := range files {
+		if f.Md5Checksum == "" || strings.HasPrefix(f.MimeType, googleAppsPrefix) {
+			// Drive computes no checksum for Google-native files, which
+			// this storage doesn't write.
+			continue
+		}
+		ids = append(ids, f.Id)
+		byId[f.Id] = f
+	}
+	err = d.batch(ids, func(id string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f := byId[id]
+		ok, err := d.verifyFile(ctx, id, f.Md5Checksum, f.AppProperties)
+		if err != nil || ok {
+			return err
+		}
+		mu.Lock()
+		failed[f.Name] = true
+		mu.Unlock()
+		return nil
+	})
+	refs := make([]string, 0, len(failed))
+	for ref := range failed {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	if ctx.Err() != nil {
+		return refs, errors.E(op, errors.IO, ctx.Err())
+	}
+	if err != nil {
+		return refs, errors.E(op, errKind(err), err)
+	}
+	return refs, nil
+}
+
+// verifyFile downloads the file with the given ID and reports whether its
+// contents match the checksum and decode as described by its appProperties.
+// A file which no longer exists passes the check.
+func (d *driveImpl) verifyFile(ctx context.Context, id, sum string, props map[string]string) (bool, error) {
+	b, err := d.download(ctx, id)
+	if isNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fmt.Sprintf("%x", md5.Sum(b)) != sum {
+		return false, nil
+	}
+	if props[partsKey] != "" || props[partOfKey] != "" {
+		// The contents of a single part don't decode on their own.
+		return true, nil
+	}
+	if props[encryptKey] == encryptValue {
+		if d.aead == nil {
+			// The contents can't be decrypted without the key, which
+			// doesn't make them corrupt.
+			return true, nil
+		}
+		if b, err = decrypt(d.aead, b); err != nil {
+			return false, nil
+		}
+	}
+	if props[compressKey] == compressValue {
+		// Decompress without keeping the contents in memory.
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return false, nil
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,50 @@
+package drive
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	d, f := newTestDrive(t)
+	d.compress = true
+	for _, ref := range []string{"good", "corrupt", "truncated"} {
+		if err := d.Put(ref, []byte("contents of "+ref)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt, truncated := f.named("corrupt")[0], f.named("truncated")[0]
+	f.mu.Lock()
+	f.files[corrupt].data[0] ^= 0xff
+	file := f.files[truncated]
+	// A consistent checksum, but the contents don't decompress.
+	file.data = file.data[:len(file.data)/2]
+	file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(file.data))
+	f.mu.Unlock()
+	// Google-native files and folders have no checksum and are skipped.
+	doc := f.add("doc", []byte("exported doc"))
+	folder := f.add("folder", nil)
+	f.mu.Lock()
+	f.files[doc].MimeType = googleAppsPrefix + "document"
+	f.files[doc].Md5Checksum = ""
+	f.files[folder].MimeType = folderMimeType
+	f.files[folder].Md5Checksum = ""
+	f.mu.Unlock()
+
+	got, err := d.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"corrupt", "truncated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Verify returned %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Verify(ctx); err == nil {
+		t.Errorf("Verify succeeded with a cancelled context")
+	}
+}